@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "runtime"
+    "time"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// benchMain runs the search given by args a number of times,
+// discards the output, and reports the throughput, the time spent
+// in each stage and the allocations per run.
+func benchMain(args []string) {
+    runs := flag.Int("runs", 5, "benchmark: the number of `runs`")
+    parseOptions(args)
+    if *runs < 1 {
+        log.Fatalf("invalid number of runs: %d\n", *runs)
+    }
+    rejectOutput("bench")
+    stopProfiles := mustProfile()
+    defer stopProfiles()
+
+    // The stats of all runs, each run reports what it added
+    stats := new(grep.Stats)
+    opts.Stats = stats
+    pat := mustCompile()
+    output = io.Discard
+
+    var wall time.Duration
+    var mallocs, allocated uint64
+    for i := 1; i <= *runs; i++ {
+        ctx, cancel := context.Background(), context.CancelFunc(func() {})
+        if *timeout > 0 {
+            ctx, cancel = context.WithTimeout(ctx, *timeout)
+        }
+
+        files, bytes := stats.Files(), stats.Bytes()
+        var before, after runtime.MemStats
+        runtime.GC()
+        runtime.ReadMemStats(&before)
+        start := time.Now()
+
+        grep.Search(ctx, pat, commandLineFiles(roots()), grep.WriterSink(output, pat))
+
+        elapsed := time.Since(start)
+        runtime.ReadMemStats(&after)
+        cancel()
+
+        fmt.Printf("run %d: %s, %d files, %s, %s\n", i, elapsed.Round(time.Microsecond),
+            stats.Files()-files, megabytes(stats.Bytes()-bytes),
+            throughput(stats.Bytes()-bytes, elapsed))
+
+        wall += elapsed
+        mallocs += after.Mallocs - before.Mallocs
+        allocated += after.TotalAlloc - before.TotalAlloc
+    }
+
+    n := int64(*runs)
+    fmt.Printf("mean: %s, %s\n", (wall / time.Duration(n)).Round(time.Microsecond),
+        throughput(stats.Bytes(), wall))
+    fmt.Printf("stages per run (summed over all goroutines):")
+    for stage, name := range grep.StageNames {
+        d := stats.Stage(stage) / time.Duration(n)
+        fmt.Printf(" %s %s", name, d.Round(time.Microsecond))
+    }
+    fmt.Println()
+    fmt.Printf("allocations per run: %d (%s)\n", mallocs/uint64(n),
+        megabytes(int64(allocated/uint64(n))))
+}
+
+// megabytes formats a number of bytes in MB
+func megabytes(n int64) string {
+    return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// throughput formats the MB/s for n bytes read in d
+func throughput(n int64, d time.Duration) string {
+    if d <= 0 {
+        return "- MB/s"
+    }
+    return fmt.Sprintf("%.1f MB/s", float64(n)/(1<<20)/d.Seconds())
+}
+
+// reportStats prints the bytes read in the last interval for --stats,
+// until the returned function is called, which prints the totals
+func reportStats(stats *grep.Stats, interval time.Duration) func() {
+    start := time.Now()
+    done := make(chan struct{})
+    finished := make(chan struct{})
+    go func() {
+        defer close(finished)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        last, lastTime := int64(0), start
+        for {
+            select {
+            case now := <-ticker.C:
+                read := stats.Bytes()
+                fmt.Fprintf(os.Stderr, "stats: %d files, %s, now %s\n", stats.Files(),
+                    megabytes(read), throughput(read-last, now.Sub(lastTime)))
+                last, lastTime = read, now
+            case <-done:
+                return
+            }
+        }
+    }()
+    return func() {
+        close(done)
+        <-finished
+        elapsed := time.Since(start)
+        fmt.Fprintf(os.Stderr, "stats: %d files, %s in %s, %s\n", stats.Files(),
+            megabytes(stats.Bytes()), elapsed.Round(time.Millisecond),
+            throughput(stats.Bytes(), elapsed))
+    }
+}
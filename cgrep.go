@@ -4,111 +4,65 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "flag"
     "fmt"
     "runtime"
     "os"
     "path/filepath"
     "log"
-    "regexp"
-    "bufio"
-    "bytes"
     "io"
-)
-
-// We use as many go routines as workes as there are cores/processors
-// in the computer.
-var cntWorkers = runtime.NumCPU()
+    "strings"
+    "time"
 
-// The Result struct that is returned with every match of the regexp
-type Result struct {
-    fname string
-    lino  int
-    line  string
-}
+    "github.com/miromotl/concurrent-grep/grep"
+)
 
-// The Job struct holds the filename and the result channel
-// of the current job
-type Job struct {
-    fname   string
-    results chan<- Result
-}
+// The results are printed to output
+var output io.Writer = os.Stdout
 
-// Do does the job for one file: matches the regex for each line
-// and returns the result in an channel.
-func (job Job) Do(lineRx *regexp.Regexp) {
-    file, err := os.Open(job.fname)
-    if err != nil {
-        log.Printf("error: %s\n", err)
-    }
-    defer file.Close()
+// The options of the search, the command line sets them
+var opts grep.Options
 
-    reader := bufio.NewReader(file)
-    for lino := 1; ; lino++ {
-        line, err := reader.ReadBytes('\n')
-        line = bytes.TrimRight(line, "\n\r")
-        
-        if lineRx.Match(line) {
-            job.results <- Result{job.fname, lino, string(line)}
-        }
+// Command line options of the command itself
+var (
+    timeout       = flag.Duration("timeout", 0, "give up on the whole search after this long (0 means no limit)")
+    colorMode     = flag.String("color", "auto", "color the output: `when` is auto, always or never")
+    lineNumber    = flag.Bool("n", false, "print the line numbers, the default when the output is a terminal or JSON")
+    noLineNumber  = flag.Bool("no-line-number", false, "don't print the line numbers")
+    withFilename  = flag.Bool("H", false, "print the file name with each match, the default for more than one file")
+    noFilename    = flag.Bool("h", false, "don't print file names with the matches, the default for a single file")
+    profileSpec   = flag.String("profile", "", "write the `profiles` kind=file, e.g. cpu=cpu.out,mem=mem.out, the kinds are cpu, mem, block and mutex")
+    pprofAddr     = flag.String("pprof", "", "serve the pprof handlers on `address`, e.g. localhost:6060")
+    daemonSocket  = flag.String("socket", "", "the unix `socket` of cgrep daemon, by default cgrep.sock in $XDG_RUNTIME_DIR or in a private directory in the temporary directory")
+    useDaemon     = flag.Bool("daemon", false, "with -r, search the files of a running cgrep daemon, as of its last walk, which misses newer files")
+    daemonRefresh = flag.Duration("refresh", time.Minute, "with cgrep daemon, walk the roots again after this long (0 never walks them again)")
+    outputName    = flag.String("output", "", "write the results to `file` instead of stdout, which only appears once they are complete, gzip compressed if it ends in .gz")
+    failOnMatch   = flag.Bool("fail-on-match", false, "exit with status 1, if anything matches, e.g. to fail a CI check on forbidden patterns")
+    failIfMissing = flag.Bool("fail-if-missing", false, "exit with status 1, if nothing matches, e.g. to fail a CI check on a missing required pattern")
+    showStats     = flag.Bool("stats", false, "print the files and bytes read so far, and the current throughput, every second on stderr")
+    exprs         expressions
+)
 
-        if err != nil {
-            // Normally, we have reached EOF here
-            if err != io.EOF {
-                log.Printf("error: %d: %s\n", err)
-            }
-            break
-        }
-    }
+func init() {
+    opts.Flags(flag.CommandLine)
+    flag.BoolVar(lineNumber, "line-number", false, "the same as -n")
+    flag.BoolVar(withFilename, "with-filename", false, "the same as -H")
+    flag.BoolVar(noFilename, "no-filename", false, "the same as -h")
+    flag.Var(&exprs, "e", "search for `regexp`, may be repeated instead of the regexp argument, matches tell which one matched")
 }
 
-// grep organizes the work:
-// Creates the worker jobs, the communication channels
-// and sets the whole machine to work
-func grep(lineRx *regexp.Regexp, fnames []string) {
-    // jobs channel is used for passing on jobs
-    jobs := make(chan Job, cntWorkers)
-    // results channel is used for collecting results
-    results := make(chan Result, len(fnames))
-    // done channel is used for signaling that a worker is done with its job
-    done := make(chan struct{}, cntWorkers)
-
-    // Each file is a job to do.
-    // Add a Job struct to the jobs channel for each file, 
-    // and then close the channel.
-    go func() {
-        for _, fname := range fnames {
-            jobs <- Job{fname, results}
-        }
-        close(jobs)
-    }()
-
-    // Setup the worker goroutines that process
-    // the jobs channel
-    for i := 0; i < cntWorkers; i++ {
-        go func() {
-            for job := range jobs {
-                job.Do(lineRx)
-            }
-            // jobs channel has been closed:
-            // Signal that work has been done
-            done <- struct{}{}
-        }()
-    }
+// expressions is the flag value of the repeatable -e option
+type expressions []string
 
-    // Wait for the completion of all worker goroutines, and
-    // then close the results channel
-    go func() {
-        for i := 0; i < cntWorkers; i++ {
-            <-done
-        }
-        close(results)
-    }()
+func (e *expressions) String() string {
+    return strings.Join(*e, ", ")
+}
 
-    // Process the results in the main goroutine, reading from
-    // the results channel until it is have been closed
-    for result := range results {
-        fmt.Printf("%s:%d:%s\n", result.fname, result.lino, result.line)
-    }
+func (e *expressions) Set(value string) error {
+    *e = append(*e, value)
+    return nil
 }
 
 // commandLineFiles globs the files in a Windows environement, otherwise
@@ -134,19 +88,218 @@ func commandLineFiles(fnames []string) []string {
     return fnames
 }
 
+// roots returns the files and directories to search from the command
+// line. A recursive search without any searches the current directory,
+// otherwise the standard input is searched, which "-" stands for too.
+func roots() []string {
+    files := flag.Args()
+    if regexpArg() && len(files) > 0 {
+        files = files[1:]
+    }
+    if len(files) == 0 && (opts.Recursive || opts.Follow) {
+        return []string{"."}
+    }
+    if len(files) == 0 {
+        return []string{"-"}
+    }
+    return files
+}
+
+// regexpArg reports whether the first argument is the regexp,
+// which it isn't with -e or --preset
+func regexpArg() bool {
+    return opts.Preset == "" && len(exprs) == 0
+}
+
+// severalFiles reports whether fnames is more than a single file,
+// which is the case for a directory as well
+func severalFiles(fnames []string) bool {
+    if len(fnames) != 1 {
+        return true
+    }
+    if grep.IsURL(fnames[0]) || grep.IsStdin(fnames[0]) {
+        return false
+    }
+    info, err := os.Stat(grep.OSPath(fnames[0]))
+    return err == nil && info.IsDir()
+}
+
+// usage prints the usage string together with the options
+func usage() {
+    name := filepath.Base(os.Args[0])
+    fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] <regexp> [<files>]\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s -e <regexp> [-e <regexp>...] [options] [<files>]\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s --preset <packs> [options] [<files>]\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s bench [options] <regexp> <files>\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s image [options] <regexp> <image tarball>\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s fmt [options] <results> [<results>]\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s serve [options]\n", name)
+    fmt.Fprintf(flag.CommandLine.Output(), "       %s daemon [options] [<roots>]\n", name)
+    flag.PrintDefaults()
+}
+
+// parseOptions parses the command line options in args and checks them.
+// It prints the usage string and exits, if the regexp is missing.
+func parseOptions(args []string) {
+    flag.Usage = usage
+    flag.CommandLine.Parse(args)
+    if flag.NArg() == 0 && regexpArg() {
+        usage()
+        os.Exit(1)
+    }
+    checkOptions()
+}
+
+// checkOptions checks the parsed options and sets up what depends on
+// them. It exits on invalid options.
+func checkOptions() {
+    opts.Filenames = *withFilename || !*noFilename && severalFiles(roots())
+
+    if *lineNumber && *noLineNumber {
+        log.Fatalf("-n and --no-line-number exclude each other\n")
+    }
+    // Line numbers only clutter the output for other programs, like in rg
+    opts.LineNumbers = *lineNumber || !*noLineNumber && (opts.JSON || toTerminal())
+
+    if *failOnMatch && *failIfMissing {
+        log.Fatalf("--fail-on-match and --fail-if-missing exclude each other\n")
+    }
+
+    switch *colorMode {
+    case "never":
+        opts.Color = false
+    case "auto":
+        opts.Color = toTerminal() && os.Getenv("TERM") != "dumb"
+    case "always":
+        opts.Color = true
+    default:
+        log.Fatalf("invalid --color mode: %s\n", *colorMode)
+    }
+
+    if err := opts.Validate(); err != nil {
+        log.Fatalf("%s\n", err)
+    }
+}
+
+// isTerminal reports whether file is a character device, like a terminal
+func isTerminal(file *os.File) bool {
+    info, err := file.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// toTerminal reports whether the results go to a terminal
+func toTerminal() bool {
+    return *outputName == "" && isTerminal(os.Stdout)
+}
+
+// mustCompile compiles the regular expression from the command line,
+// the -e patterns or the rules of the --preset, and the --format template,
+// which may refer to its groups. It exits on errors.
+func mustCompile() *grep.Pattern {
+    expr := exprs
+    if regexpArg() {
+        expr = expressions{flag.Arg(0)}
+    }
+    pat, err := grep.Compile(opts, expr...)
+    if err != nil {
+        log.Fatalf("%s\n", err)
+    }
+    return pat
+}
+
 func main() {
     runtime.GOMAXPROCS(runtime.NumCPU()) // Use all the machine's cores
 
-    // Print usage string, if needed
-    if len(os.Args) < 3 || os.Args[1] == "-h" || os.Args[1] == "--help" {
-        fmt.Printf("usage: %s <regexp> <files>\n", filepath.Base(os.Args[0]))
-        os.Exit(1)
+    // "cgrep bench ..." measures the search instead of printing
+    // its results. Use "cgrep -- bench ..." to search for "bench",
+    // likewise for the other commands.
+    if len(os.Args) > 1 && os.Args[1] == "bench" {
+        benchMain(os.Args[2:])
+        return
+    }
+    // "cgrep image ..." searches the layers of a container image
+    if len(os.Args) > 1 && os.Args[1] == "image" {
+        imageMain(os.Args[2:])
+        return
+    }
+
+    // "cgrep daemon ..." keeps the files to search in memory for the CLI
+    if len(os.Args) > 1 && os.Args[1] == "daemon" {
+        daemonMain(os.Args[2:])
+        return
+    }
+    // "cgrep fmt ..." prints the results of earlier --json searches again
+    if len(os.Args) > 1 && os.Args[1] == "fmt" {
+        fmtMain(os.Args[2:])
+        return
+    }
+    // "cgrep serve ..." answers searches of editors on stdin and stdout
+    if len(os.Args) > 1 && os.Args[1] == "serve" {
+        serveMain(os.Args[2:])
+        return
+    }
+
+    // Parse the options, print usage string, if needed
+    parseOptions(os.Args[1:])
+    stopProfiles := mustProfile()
+    defer stopProfiles()
+
+    // The global deadline covers the whole run
+    ctx := context.Background()
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
+    }
+
+    // The stats are collected by the search, the options of the
+    // pattern have them
+    var stats *grep.Stats
+    if *showStats {
+        stats = new(grep.Stats)
+        opts.Stats = stats
     }
 
     // Compile the regular expression, on success call grep
-    if lineRx, err := regexp.Compile(os.Args[1]); err != nil {
-        log.Fatalf("invalid regexp: %s\n", err)
-    } else {
-        grep(lineRx, commandLineFiles(os.Args[2:]))
+    pat := mustCompile()
+
+    // With --output the results only get there, when they are complete.
+    // The file is only created, once nothing can fail before the search.
+    out := mustOutput()
+    sink := grep.WriterSink(output, pat)
+    var summary *grep.DirSummary
+    if opts.SummaryByDir {
+        summary = grep.NewDirSummary(pat)
+        sink = summary.Add
+    }
+    // The errors of the search decide the exit status
+    sink, searched := keepSummary(sink)
+
+    stopStats := func() {}
+    if stats != nil {
+        stopStats = reportStats(stats, time.Second)
     }
-}
\ No newline at end of file
+
+    // A running cgrep daemon has the files of a recursive search at hand,
+    // as they were when it walked them last
+    err := errNoDaemon
+    if daemonable() {
+        err = searchDaemon(ctx, pat, sink)
+    }
+    if errors.Is(err, errNoDaemon) {
+        err = grep.Search(ctx, pat, commandLineFiles(roots()), sink)
+    }
+    if err != nil {
+        log.Printf("error: %s\n", err)
+    }
+    if summary != nil {
+        summary.Print(output)
+    }
+    stopStats()
+    err = commitOutput(out, err)
+
+    if status := exitStatus(ctx, err, searched()); status != 0 {
+        stopProfiles()
+        os.Exit(status)
+    }
+}
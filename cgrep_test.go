@@ -0,0 +1,37 @@
+package main
+
+import (
+    "flag"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// setOptions parses args like the command line, after setting all
+// options back to their defaults, and returns the compiled pattern.
+// The options are set back again when the test is done.
+func setOptions(t *testing.T, args ...string) *grep.Pattern {
+    t.Helper()
+    resetOptions()
+    t.Cleanup(resetOptions)
+    if err := flag.CommandLine.Parse(args); err != nil {
+        t.Fatal(err)
+    }
+    checkOptions()
+    return mustCompile()
+}
+
+// resetOptions sets all options to their defaults
+func resetOptions() {
+    opts = grep.Options{}
+    flag.VisitAll(func(f *flag.Flag) {
+        if !strings.HasPrefix(f.Name, "test.") {
+            f.Value.Set(f.DefValue)
+        }
+    })
+    // The options the command line doesn't set, and the repeatable
+    // ones, don't take their defaults
+    exprs, output = nil, os.Stdout
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "log"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// The CLI gives up on the daemon, if it doesn't answer this fast
+const daemonDialTimeout = 50 * time.Millisecond
+
+// The options the daemon can search with. With any other option on the
+// command line, the CLI searches itself.
+var daemonOptions = map[string]bool{
+    "r": true, "i": true, "F": true, "A": true, "B": true, "C": true,
+    "c": true, "count": true, "l": true, "n": true, "line-number": true, "no-line-number": true,
+    "H": true, "h": true, "with-filename": true, "no-filename": true,
+    "color": true, "colors": true, "json": true, "socket": true, "output": true, "daemon": true,
+}
+
+// daemonMain runs "cgrep daemon [options] <roots>": it walks the roots,
+// the current directory by default, and keeps their files in memory, so
+// that the .gitignore and .ignore rules aren't read again for every
+// search. The roots are walked again every --refresh. It answers the
+// requests of serve mode on a unix socket, one connection per client,
+// and the recursive searches of the CLI with --daemon. The searches of
+// all clients run one after the other.
+func daemonMain(args []string) {
+    flag.Usage = usage
+    flag.CommandLine.Parse(args)
+    checkOptions()
+    rejectOutput("daemon")
+    if opts.LineStart != 1 {
+        log.Fatalf("daemon: --line-number-start isn't supported, the clients number the lines\n")
+    }
+    stopProfiles := mustProfile()
+    defer stopProfiles()
+    setupServer()
+    // The clients print the line numbers or not, they need them anyway
+    // to keep the context lines between two matches from being repeated
+    opts.LineNumbers = true
+
+    roots := flag.Args()
+    if len(roots) == 0 {
+        roots = []string{"."}
+    }
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    files, err := newFileCache(ctx, roots)
+    if err != nil {
+        log.Fatalf("daemon: %s\n", err)
+    }
+    go files.refresh(ctx, *daemonRefresh)
+
+    socket := socketPath()
+    if dir := filepath.Dir(socket); dir == tempSocketDir() {
+        if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+            log.Fatalf("daemon: %s\n", err)
+        }
+        if err := checkPrivate(dir); err != nil {
+            log.Fatalf("daemon: %s\n", err)
+        }
+    }
+    if conn, err := net.DialTimeout("unix", socket, daemonDialTimeout); err == nil {
+        conn.Close()
+        log.Fatalf("daemon: already running on %s\n", socket)
+    }
+    // A socket left behind by a daemon that died
+    os.Remove(socket)
+    // The daemon reads whatever its user may read, nobody else may ask
+    listener, err := listenPrivate(socket)
+    if err != nil {
+        log.Fatalf("daemon: %s\n", err)
+    }
+    defer os.Remove(socket)
+    context.AfterFunc(ctx, func() { listener.Close() })
+
+    srv := newServer(files)
+    var sessions sync.WaitGroup
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Printf("error: daemon: %s\n", err)
+            }
+            break
+        }
+        sessions.Add(1)
+        go func() {
+            defer sessions.Done()
+            defer conn.Close()
+            stop := context.AfterFunc(ctx, func() { conn.Close() })
+            defer stop()
+            srv.serve(conn, conn)
+        }()
+    }
+    sessions.Wait()
+    srv.close()
+}
+
+// socketPath returns the --socket of the daemon, by default cgrep.sock
+// in $XDG_RUNTIME_DIR, or in a directory of the user in the temporary
+// directory
+func socketPath() string {
+    if *daemonSocket != "" {
+        return *daemonSocket
+    }
+    if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+        return filepath.Join(dir, "cgrep.sock")
+    }
+    return filepath.Join(tempSocketDir(), "cgrep.sock")
+}
+
+// tempSocketDir returns the directory of the socket without
+// $XDG_RUNTIME_DIR. Only the user may enter it, as everybody may write
+// to the temporary directory, and so replace a socket there.
+func tempSocketDir() string {
+    return filepath.Join(os.TempDir(), fmt.Sprintf("cgrep-%d", os.Getuid()))
+}
+
+// checkSocket returns an error, unless the socket, and the directory of
+// the default one in the temporary directory, are private to the user
+func checkSocket(socket string) error {
+    if dir := filepath.Dir(socket); dir == tempSocketDir() {
+        if err := checkPrivate(dir); err != nil {
+            return err
+        }
+    }
+    return checkPrivate(socket)
+}
+
+// fileCache holds the files below the roots of the daemon, as absolute
+// paths
+type fileCache struct {
+    roots []string
+    walk  walkParams // the options the roots are walked with
+    mu    sync.RWMutex
+    files []string
+}
+
+// newFileCache walks the roots for the first time
+func newFileCache(ctx context.Context, roots []string) (*fileCache, error) {
+    c := &fileCache{walk: *walkOptions()}
+    for _, root := range roots {
+        abs, err := filepath.Abs(root)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := os.Stat(abs); err != nil {
+            return nil, err
+        }
+        c.roots = append(c.roots, abs)
+    }
+    c.load(ctx)
+    return c, nil
+}
+
+// load walks the roots, the files that can't be read are reported by
+// the searches
+func (c *fileCache) load(ctx context.Context) {
+    var files []string
+    for path := range grep.Walk(ctx, c.roots, opts, func(error) {}) {
+        files = append(files, path)
+    }
+    if ctx.Err() != nil {
+        return
+    }
+    c.mu.Lock()
+    c.files = files
+    c.mu.Unlock()
+}
+
+// refresh walks the roots again every interval, until the context is done
+func (c *fileCache) refresh(ctx context.Context, interval time.Duration) {
+    if interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            c.load(ctx)
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// lookup returns the cached files below the paths, relative to cwd, and
+// the names a walk of the paths would give them. It returns false, if a
+// path isn't below any of the roots.
+func (c *fileCache) lookup(cwd string, paths []string) ([]string, map[string]string, bool) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    var files []string
+    names := make(map[string]string)
+    for _, path := range paths {
+        abs := path
+        if !filepath.IsAbs(abs) {
+            if cwd == "" {
+                return nil, nil, false
+            }
+            abs = filepath.Join(cwd, path)
+        }
+        abs = filepath.Clean(abs)
+        if !c.covers(abs) {
+            return nil, nil, false
+        }
+        for _, file := range c.files {
+            if rel, ok := below(abs, file); ok {
+                files = append(files, file)
+                names[file] = filepath.Join(path, rel)
+            }
+        }
+    }
+    return files, names, true
+}
+
+// rename gives the result the name of its file on the command line
+// of the client
+func rename(result grep.Result, names map[string]string) grep.Result {
+    if name, ok := names[result.File]; ok {
+        result.File = name
+    }
+    if fe := result.Err; fe != nil {
+        if name, ok := names[fe.File]; ok {
+            renamed := *fe
+            renamed.File, renamed.Text = name, strings.Replace(fe.Text, fe.File, name, 1)
+            result.Err = &renamed
+        }
+    }
+    return result
+}
+
+// covers reports whether path is a root or below one
+func (c *fileCache) covers(path string) bool {
+    for _, root := range c.roots {
+        if _, ok := below(root, path); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// below returns path relative to dir, if it is dir or below it
+func below(dir, path string) (string, bool) {
+    if path == dir {
+        return "", true
+    }
+    rest, ok := strings.CutPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+    return rest, ok
+}
+
+// errNoDaemon tells the CLI to search itself
+var errNoDaemon = errors.New("no daemon")
+
+// daemonable reports whether the daemon may run the search of the
+// command line: a recursive search for a regexp with --daemon and the
+// options the daemon knows. Its files may be out of date, so it is
+// never used without asking.
+func daemonable() bool {
+    if !*useDaemon || !(opts.Recursive || opts.Follow) || !regexpArg() {
+        return false
+    }
+    ok := true
+    flag.Visit(func(f *flag.Flag) {
+        if !daemonOptions[f.Name] {
+            ok = false
+        }
+    })
+    for _, root := range roots() {
+        if grep.IsStdin(root) || grep.IsURL(root) {
+            ok = false
+        }
+    }
+    return ok
+}
+
+// walkOptions returns the options of the walk of the command line
+func walkOptions() *walkParams {
+    return &walkParams{NoIgnore: opts.NoIgnore, MaxDepth: opts.MaxDepth, Follow: opts.Follow, Devices: opts.Devices}
+}
+
+// searchDaemon sends the search of the command line to the daemon, and
+// passes the results on to sink. It returns errNoDaemon, before anything
+// is passed on, if there is no daemon, or it doesn't have the files.
+func searchDaemon(ctx context.Context, pat *grep.Pattern, sink grep.Sink) error {
+    socket := socketPath()
+    if _, err := os.Stat(socket); err != nil {
+        return errNoDaemon
+    }
+    // The patterns and the directory go to whoever listens on the socket
+    if err := checkSocket(socket); err != nil {
+        log.Printf("warning: not using cgrep daemon: %s\n", err)
+        return errNoDaemon
+    }
+    conn, err := net.DialTimeout("unix", socket, daemonDialTimeout)
+    if err != nil {
+        return errNoDaemon
+    }
+    defer conn.Close()
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+
+    cwd, err := os.Getwd()
+    if err != nil {
+        return errNoDaemon
+    }
+    o := pat.Options()
+    params := searchParams{Pattern: flag.Arg(0), Paths: roots(), Cwd: cwd,
+        IgnoreCase: &o.IgnoreCase, FixedStrings: &o.FixedStrings, Before: &o.Before, After: &o.After,
+        Count: &o.CountOnly, FilesWithMatches: &o.FilesOnly, Walk: walkOptions()}
+    raw, err := json.Marshal(params)
+    if err != nil {
+        return err
+    }
+    req := rpcRequest{Version: "2.0", ID: json.RawMessage("1"), Method: "search", Params: raw}
+    if err := json.NewEncoder(conn).Encode(req); err != nil {
+        return errNoDaemon
+    }
+
+    reader := bufio.NewReader(conn)
+    started := false
+    var last grep.Result
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            if !started {
+                return errNoDaemon
+            }
+            if ctx.Err() != nil {
+                return nil
+            }
+            return fmt.Errorf("daemon: %s", err)
+        }
+        var msg struct {
+            Method string           `json:"method"`
+            Params resultParams     `json:"params"`
+            Result *json.RawMessage `json:"result"`
+            Error  *rpcError        `json:"error"`
+        }
+        if err := json.Unmarshal(line, &msg); err != nil {
+            return fmt.Errorf("daemon: %s", err)
+        }
+        switch {
+        case msg.Error != nil && msg.Error.Code == rpcNotCached && !started:
+            return errNoDaemon
+        case msg.Error != nil:
+            return fmt.Errorf("daemon: %s", msg.Error.Message)
+        case msg.Result != nil:
+            return nil
+        case msg.Method == "result":
+            started = true
+            results, err := grep.ParseRecord(msg.Params.Record)
+            if err != nil {
+                return fmt.Errorf("daemon: %s", err)
+            }
+            for _, result := range results {
+                // A context line may be after a match and before the next
+                if result.File == last.File && result.Line > 0 && result.Line <= last.Line {
+                    continue
+                }
+                if result.File != "" {
+                    last = result
+                }
+                if err := sink(result); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+}
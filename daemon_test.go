@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+func TestDaemonPaths(t *testing.T) {
+    setOptions(t, "foo")
+    root := filepath.FromSlash("/src/project")
+    srv := &server{files: &fileCache{roots: []string{root}, walk: *walkOptions(),
+        files: []string{filepath.Join(root, "a.go"), filepath.Join(root, "sub", "b.go")}}}
+
+    files, names, _, err := srv.paths(searchParams{Paths: []string{"sub"}, Cwd: root, Walk: walkOptions()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := filepath.Join(root, "sub", "b.go"); len(files) != 1 || files[0] != want {
+        t.Errorf("got files %q, want %q", files, want)
+    }
+    if got, want := names[files[0]], filepath.Join("sub", "b.go"); got != want {
+        t.Errorf("got name %q, want %q", got, want)
+    }
+
+    // The daemon doesn't have the files of other roots, or of another walk
+    if _, _, code, _ := srv.paths(searchParams{Paths: []string{"/elsewhere"}}); code != rpcNotCached {
+        t.Errorf("outside the roots: got code %d, want %d", code, rpcNotCached)
+    }
+    other := *walkOptions()
+    other.NoIgnore = true
+    if _, _, code, _ := srv.paths(searchParams{Paths: []string{root}, Walk: &other}); code != rpcNotCached {
+        t.Errorf("with --no-ignore: got code %d, want %d", code, rpcNotCached)
+    }
+}
+
+func TestCheckPrivate(t *testing.T) {
+    if runtime.GOOS == "windows" {
+        t.Skip("no file modes on this system")
+    }
+    dir := t.TempDir()
+    if err := os.Chmod(dir, 0o700); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkPrivate(dir); err != nil {
+        t.Errorf("0700: %s", err)
+    }
+    if err := os.Chmod(dir, 0o755); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkPrivate(dir); err == nil {
+        t.Errorf("0755: got no error")
+    }
+}
+
+// The --daemon searches of --json get the named groups, and only the
+// user may connect to the socket
+func TestDaemonGroups(t *testing.T) {
+    if runtime.GOOS == "windows" {
+        t.Skip("no file modes on this system")
+    }
+    dir := t.TempDir()
+    fname := filepath.Join(dir, "a.txt")
+    if err := os.WriteFile(fname, []byte("key=value\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    socket := filepath.Join(dir, "cgrep.sock")
+    pat := setOptions(t, "--json", "--socket", socket, "-r", `(?P<key>\w+)=(?P<value>\w+)`, dir)
+    listener, err := listenPrivate(socket)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    if info, err := os.Stat(socket); err != nil || info.Mode().Perm()&0o077 != 0 {
+        t.Fatalf("got socket %v, %v, want it private", info.Mode(), err)
+    }
+    srv := newServer(&fileCache{roots: []string{dir}, walk: *walkOptions(), files: []string{fname}})
+    defer srv.close()
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        srv.serve(conn, conn)
+    }()
+
+    var groups []grep.Group
+    err = searchDaemon(context.Background(), pat, func(result grep.Result) error {
+        if result.Summary == nil {
+            groups = append(groups, result.Groups...)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []grep.Group{{Name: "key", Text: "key", Start: 0, End: 3}, {Name: "value", Text: "value", Start: 4, End: 9}}
+    if len(groups) != len(want) || groups[0] != want[0] || groups[1] != want[1] {
+        t.Errorf("got groups %+v, want %+v", groups, want)
+    }
+}
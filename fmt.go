@@ -0,0 +1,287 @@
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// The longest record of a result file
+const maxRecordSize = 64 << 20
+
+// fmtMain runs "cgrep fmt [options] <results> [<results>]": it reads the
+// --json output of earlier searches and prints it again, like a search
+// would with the options, or --to heading, vimgrep or csv. With two
+// result files --merge prints the matches of both, and --diff those of
+// the second that aren't in the first, like the new matches of a run.
+func fmtMain(args []string) {
+    to := flag.String("to", "text", "fmt: print the results as `format`: text, json, heading, vimgrep or csv")
+    merge := flag.Bool("merge", false, "fmt: print the matches of both result files")
+    diff := flag.Bool("diff", false, "fmt: print the matches of the second result file, that aren't in the first")
+    flag.Usage = usage
+    flag.CommandLine.Parse(args)
+    files := flag.Args()
+    switch {
+    case len(files) == 0 || len(files) > 2:
+        log.Fatalf("fmt: expected one or two result files\n")
+    case *merge && *diff:
+        log.Fatalf("fmt: --merge and --diff exclude each other\n")
+    case len(files) == 2 && !*merge && !*diff:
+        log.Fatalf("fmt: two result files need --merge or --diff\n")
+    case len(files) == 1 && (*merge || *diff):
+        log.Fatalf("fmt: --merge and --diff need two result files\n")
+    }
+    switch *to {
+    case "text", "heading", "vimgrep", "csv":
+    case "json":
+        opts.JSON = true
+    default:
+        log.Fatalf("fmt: invalid format: %s\n", *to)
+    }
+    checkOptions()
+
+    var results [][]grep.Result
+    for _, name := range files {
+        read, err := readResults(name)
+        if err != nil {
+            log.Fatalf("fmt: %s\n", err)
+        }
+        results = append(results, read)
+    }
+    shown := results[0]
+    switch {
+    case *merge:
+        shown = mergeResults(matchesOf(results[0]), matchesOf(results[1]))
+    case *diff:
+        shown = diffResults(matchesOf(results[0]), matchesOf(results[1]))
+    }
+
+    fmtOptions(shown)
+    if (opts.CountOnly || opts.FilesOnly) && *to != "text" && *to != "json" {
+        log.Fatalf("fmt: --to %s needs the matches, not -c or -l results\n", *to)
+    }
+
+    out := mustOutput()
+    err := printResults(output, *to, shown)
+    if out != nil {
+        // After a failed write commit removes the file
+        if outErr := out.commit(); err == nil {
+            err = outErr
+        }
+    }
+    if err != nil {
+        log.Fatalf("fmt: %s\n", err)
+    }
+}
+
+// fmtOptions sets the options to print the results like they were
+// searched: -c or -l, with line numbers, and with the context lines of
+// -A and -B, which go into the match records again with --to json
+func fmtOptions(shown []grep.Result) {
+    opts.CountOnly, opts.CountMatches, opts.FilesOnly = false, false, false
+    opts.LineNumbers = false
+    for _, result := range shown {
+        switch {
+        case result.Line > 0:
+            opts.LineNumbers = !*noLineNumber
+        case listed(result) && result.Count > 0:
+            opts.CountOnly = true
+        case listed(result):
+            opts.FilesOnly = true
+        }
+    }
+    opts.Filenames = !*noFilename
+    opts.Context = 0
+    opts.Before, opts.After = contextSpans(shown)
+}
+
+// contextSpans returns the most context lines right before and right
+// after a match in the results
+func contextSpans(results []grep.Result) (int, int) {
+    before, after := 0, 0
+    for i, result := range results {
+        if result.Context || listed(result) || result.Line == 0 {
+            continue
+        }
+        n := 0
+        for j := i - 1; j >= 0 && isContext(results[j], result.File, result.Line-n-1); j-- {
+            n++
+        }
+        before = max(before, n)
+        n = 0
+        for j := i + 1; j < len(results) && isContext(results[j], result.File, result.Line+n+1); j++ {
+            n++
+        }
+        after = max(after, n)
+    }
+    return before, after
+}
+
+// isContext reports whether result is the context line lino of fname
+func isContext(result grep.Result, fname string, lino int) bool {
+    return result.Context && result.File == fname && result.Line == lino
+}
+
+// printResults prints the results --to the format on w, and the
+// summary, if they have none
+func printResults(w io.Writer, to string, shown []grep.Result) error {
+    // The matches aren't known any more, the pattern matches nothing
+    matchNothing := opts
+    matchNothing.BasicRegexp, matchNothing.ExtendedRegexp = false, false
+    matchNothing.Glob, matchNothing.FixedStrings = false, false
+    matchNothing.Preset, matchNothing.Format = "", ""
+    pat, err := grep.Compile(matchNothing, `[^\x00-\x{10FFFF}]`)
+    if err != nil {
+        return err
+    }
+    var sink grep.Sink
+    switch to {
+    case "text", "json":
+        sink = grep.WriterSink(w, pat)
+    case "heading":
+        sink = grep.HeadingSink(w, pat)
+    case "vimgrep":
+        sink = grep.VimgrepSink(w, pat)
+    case "csv":
+        sink = grep.CSVSink(w, pat)
+    }
+
+    for _, result := range shown {
+        if err := sink(result); err != nil {
+            return err
+        }
+    }
+    if len(shown) == 0 || shown[len(shown)-1].Summary == nil {
+        // The summary of merged results is made again
+        return sink(grep.Result{Summary: summarize(shown)})
+    }
+    return nil
+}
+
+// readResults reads the records of a --json result file, - for stdin
+func readResults(name string) ([]grep.Result, error) {
+    var r io.Reader = os.Stdin
+    if !grep.IsStdin(name) {
+        file, err := os.Open(grep.OSPath(name))
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+        r = file
+    }
+
+    var results []grep.Result
+    var last grep.Result
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(nil, maxRecordSize)
+    for lino := 1; scanner.Scan(); lino++ {
+        if len(scanner.Bytes()) == 0 {
+            continue
+        }
+        read, err := grep.ParseRecord(scanner.Bytes())
+        if err != nil {
+            return nil, fmt.Errorf("%s:%d: %s", name, lino, err)
+        }
+        for _, result := range read {
+            // A context line may be after a match and before the next
+            if result.File == last.File && result.Line > 0 && result.Line <= last.Line {
+                continue
+            }
+            if result.File != "" {
+                last = result
+            }
+            results = append(results, result)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("%s: %s", name, err)
+    }
+    return results, nil
+}
+
+// matchesOf returns the matches among the results, which are what
+// --merge and --diff compare
+func matchesOf(results []grep.Result) []grep.Result {
+    var matches []grep.Result
+    for _, result := range results {
+        if result.Err == nil && result.Summary == nil && !result.Context {
+            if listed(result) {
+                log.Fatalf("fmt: --merge and --diff need the matches, not -c or -l results\n")
+            }
+            matches = append(matches, result)
+        }
+    }
+    return matches
+}
+
+// matchKey is what tells two matches apart. The line number isn't part
+// of it, as the lines above a match may have changed since the last run.
+type matchKey struct {
+    fname, line string
+}
+
+// mergeResults returns the matches of a and the ones of b, that aren't
+// in a, ordered by file and line
+func mergeResults(a, b []grep.Result) []grep.Result {
+    merged := append(a, diffResults(a, b)...)
+    sort.SliceStable(merged, func(i, j int) bool {
+        if merged[i].File != merged[j].File {
+            return merged[i].File < merged[j].File
+        }
+        return merged[i].Line < merged[j].Line
+    })
+    return merged
+}
+
+// diffResults returns the matches of b, that aren't in a. A line that
+// is in a twice, is only left out of b twice.
+func diffResults(a, b []grep.Result) []grep.Result {
+    old := make(map[matchKey]int)
+    for _, result := range a {
+        old[matchKey{result.File, result.Text}]++
+    }
+    var added []grep.Result
+    for _, result := range b {
+        key := matchKey{result.File, result.Text}
+        if old[key] > 0 {
+            old[key]--
+            continue
+        }
+        added = append(added, result)
+    }
+    return added
+}
+
+// summarize counts the files with matches, and the matches among the results
+func summarize(results []grep.Result) *grep.Summary {
+    s := &grep.Summary{Errors: make(map[string]int)}
+    files := make(map[string]bool)
+    for _, result := range results {
+        switch {
+        case result.Err != nil:
+            s.Errors[result.Err.Message]++
+        case result.Context:
+        case listed(result):
+            files[result.File] = true
+            s.Matches += max(1, result.Count)
+        default:
+            files[result.File] = true
+            s.Matches++
+        }
+    }
+    s.Files = len(files)
+    return s
+}
+
+// listed reports whether the result is the count of a file of a -c
+// search, or the name of one of a -l search, rather than a match
+func listed(result grep.Result) bool {
+    return result.Err == nil && result.Summary == nil && !result.Context && !result.Binary &&
+        result.Line == 0 && result.Text == ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "os"
+    "path/filepath"
+    "testing"
+    "testing/fstest"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// fmt --to json prints the --json records it read again, with the
+// context lines in their matches, the groups and the binary matches
+func TestFmtJSON(t *testing.T) {
+    fsys := fstest.MapFS{
+        "a.txt": {Data: []byte("one\nfoo bar\ntwo\nthree\nfour\nfoo\nfoo baz\nfive\n")},
+        "b.txt": {Data: []byte("foo\n")},
+        "bin":   {Data: []byte("\x00\x01foo bar\x00baz foo")},
+    }
+    tests := [][]string{
+        {"(?P<word>fo+) ?(?P<rest>ba.)?"},
+        {"-B", "2", "foo"},
+        {"-A", "1", "foo"},
+        {"-n", "--binary-offsets", "foo"},
+        {"-c", "foo"},
+        {"-l", "foo"},
+    }
+    for _, args := range tests {
+        setOptions(t, append([]string{"-r", "--json"}, args...)...)
+        // The files are searched in order
+        opts.Workers = 1
+        pat := mustCompile()
+        var searched bytes.Buffer
+        if err := grep.SearchFS(context.Background(), fsys, pat, []string{"."}, grep.WriterSink(&searched, pat)); err != nil {
+            t.Fatal(err)
+        }
+        name := filepath.Join(t.TempDir(), "results.json")
+        if err := os.WriteFile(name, searched.Bytes(), 0o644); err != nil {
+            t.Fatal(err)
+        }
+
+        setOptions(t, "--json", "unused")
+        results, err := readResults(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        fmtOptions(results)
+        var printed bytes.Buffer
+        if err := printResults(&printed, "json", results); err != nil {
+            t.Fatal(err)
+        }
+        if got, want := printed.String(), searched.String(); got != want {
+            t.Errorf("%q: got\n%s\nwant\n%s", args, got, want)
+        }
+    }
+}
@@ -0,0 +1,61 @@
+package grep
+
+// batcher is the collector's buffer for --json streams: it keeps the
+// results of a file until the file is done and prints them together,
+// so that consumers get the results grouped by file. Unlike the reorder
+// buffer, it doesn't wait for the files before, the files come out in
+// the order they are done.
+type batcher struct {
+    head    int // the first file not done, it gets memory in any case
+    pending map[int][]Result
+    done    map[int]bool
+    memory  *budget
+    print   func(Result)
+}
+
+// newBatcher returns a batcher printing through print
+func newBatcher(memory *budget, print func(Result)) *batcher {
+    return &batcher{
+        pending: make(map[int][]Result),
+        done:    make(map[int]bool),
+        memory:  memory,
+        print:   print,
+    }
+}
+
+// add keeps a result, or prints the results of its file, once the file
+// is done. Errors are printed right away.
+func (b *batcher) add(result Result) {
+    switch {
+    case result.Err != nil:
+        b.print(result)
+    case result.done:
+        b.flush(result.seq)
+        b.done[result.seq] = true
+        for b.done[b.head] {
+            delete(b.done, b.head)
+            b.head++
+        }
+        b.memory.Advance(b.head)
+    default:
+        b.pending[result.seq] = append(b.pending[result.seq], result)
+        b.memory.Buffer(int64(len(result.Text)))
+    }
+}
+
+// flush prints the results kept for the file seq
+func (b *batcher) flush(seq int) {
+    for _, result := range b.pending[seq] {
+        b.print(result)
+        b.memory.Flush(int64(len(result.Text)))
+    }
+    delete(b.pending, seq)
+}
+
+// close prints the results of the files that aren't done, because
+// the search was cancelled
+func (b *batcher) close() {
+    for seq := range b.pending {
+        b.flush(seq)
+    }
+}
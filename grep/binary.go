@@ -0,0 +1,187 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "regexp/syntax"
+    "strings"
+)
+
+// A file with a NUL byte in its first binarySniffSize bytes is binary
+const binarySniffSize = 8 << 10
+
+// The matches starting in the last binaryOverlap bytes of a chunk are
+// searched in the next chunk, which begins with these bytes
+const binaryOverlap = 4 << 10
+
+// The bytes of a --binary-offsets dump before and after a match, and
+// the most bytes of the match itself
+const (
+    dumpContext = 16
+    dumpMatch   = 64
+)
+
+// isBinary reports whether the file looks binary, like in grep
+func isBinary(file *os.File) (bool, error) {
+    buf := make([]byte, binarySniffSize)
+    n, err := file.ReadAt(buf, 0)
+    if err != nil && err != io.EOF {
+        return false, err
+    }
+    return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// checkBinary rejects the anchors and word boundaries in pat with
+// --binary-offsets: a binary file has no lines, and they would match at
+// the ends of the chunks it is read in
+func checkBinary(pat *Pattern) error {
+    if !pat.opts.BinaryOffsets {
+        return nil
+    }
+    re, err := syntax.Parse(pat.lineRx.String(), syntax.Perl)
+    if err != nil {
+        return err
+    }
+    if hasOp(re, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+        syntax.OpWordBoundary, syntax.OpNoWordBoundary) {
+        return fmt.Errorf("--binary-offsets: anchors and word boundaries don't apply to binary files")
+    }
+    return nil
+}
+
+// scanBinary reports the byte offsets of the matches in a binary file
+// for --binary-offsets, with the bytes around them. The file is read in
+// chunks, which overlap, so that a match across two chunks is found.
+func (job Job) scanBinary(ctx context.Context, file io.Reader, pat *Pattern,
+    size int, found chan<- Result) (int, error) {
+    count := 0
+    buf := make([]byte, max(size, 4*binaryOverlap))
+    var base int64 // the offset of buf[0] in the file
+    var next int64 // the offset the next match may start at
+    carry := 0
+    for ctx.Err() == nil {
+        start := job.opts.Stats.now()
+        n, err := io.ReadFull(file, buf[carry:])
+        job.opts.Stats.add(readStage, start)
+        job.opts.Stats.read(n)
+        eof := err == io.EOF || err == io.ErrUnexpectedEOF
+        data := buf[:carry+n]
+        if allowed := job.scanned.take(n); allowed < n {
+            data, eof = buf[:carry+allowed], true
+        }
+        if err != nil && !eof {
+            return count, &fs.PathError{Op: "read", Path: job.fname, Err: err}
+        }
+
+        // The matches near the end may go on in the next chunk
+        safe := len(data) - binaryOverlap
+        keep := max(0, safe)
+        start = job.opts.Stats.now()
+        locs := pat.lineRx.FindAllIndex(data, -1)
+        job.opts.Stats.add(matchStage, start)
+        for _, loc := range locs {
+            if loc[0] == loc[1] || base+int64(loc[0]) < next {
+                continue
+            }
+            if !eof && loc[0] > dumpContext && (loc[0] >= safe || loc[1] == len(data)) {
+                keep = loc[0]
+                break
+            }
+            count++
+            if !job.sendBinary(ctx, found, data, base, loc) {
+                return count, nil
+            }
+            next = base + int64(loc[1])
+        }
+        if eof {
+            return count, nil
+        }
+
+        // Keep the bytes before the next matches for their aligned dumps
+        keep = max(0, min(keep, safe)-dumpContext-16)
+        carry = copy(buf, data[keep:])
+        base += int64(keep)
+    }
+    return count, nil
+}
+
+// sendBinary sends the match at loc in data, which begins at offset
+// base in the file. It returns false, if the context is done.
+func (job Job) sendBinary(ctx context.Context, found chan<- Result, data []byte,
+    base int64, loc []int) bool {
+    text := data[loc[0]:min(loc[1], loc[0]+dumpMatch)]
+    // The lines of the dump begin at the offsets in the file that are
+    // multiples of 16
+    from := loc[0] - int((base+int64(loc[0]))%16) - dumpContext
+    to := loc[0] + len(text) + dumpContext
+    to += int((16 - (base+int64(to))%16) % 16)
+    from, to = max(0, from), min(len(data), to)
+
+    if !job.memory.Acquire(ctx, int64(len(text)), job.seq) {
+        return false
+    }
+    result := Result{File: job.fname, Text: string(text), Binary: true,
+        Offset: base + int64(loc[0]), DumpOffset: base + int64(from),
+        Dump: bytes.Clone(data[from:to])}
+    select {
+    case found <- result:
+        return true
+    case <-ctx.Done():
+        job.memory.Release(int64(len(text)))
+        return false
+    }
+}
+
+// printable replaces the bytes that aren't printable ASCII by dots
+func printable(b []byte) string {
+    var s strings.Builder
+    for _, c := range b {
+        if c < ' ' || c > '~' {
+            c = '.'
+        }
+        s.WriteByte(c)
+    }
+    return s.String()
+}
+
+// hexDump formats the bytes from offset on like hexdump -C, 16 bytes
+// per line with their offset, hex codes and characters
+func hexDump(b []byte, offset int64) []string {
+    var lines []string
+    for len(b) > 0 {
+        n := min(16, len(b))
+        codes := fmt.Sprintf("% x", b[:n])
+        lines = append(lines, fmt.Sprintf("%08x  %-47s  |%s|", offset, codes, printable(b[:n])))
+        b, offset = b[n:], offset+int64(n)
+    }
+    return lines
+}
+
+// printBinary prints a match in a binary file with its offset, and the
+// dump around it, indented
+func (p *printer) printBinary(result Result) {
+    offset := fmt.Sprintf("0x%08x", result.Offset)
+    if p.opts.theme != nil {
+        offset = paint(p.opts.theme.lino, offset)
+    }
+    text := printable([]byte(result.Text))
+    if p.opts.theme != nil {
+        text = paint(p.opts.theme.match, text)
+    }
+    fmt.Fprintf(p.out, "%s%s%s%s\n", p.fname(result.File, p.opts.FieldSeparator), offset, p.opts.theme.colorSep(p.opts.FieldSeparator), text)
+    for _, line := range hexDump(result.Dump, result.DumpOffset) {
+        fmt.Fprintf(p.out, "    %s\n", line)
+    }
+}
+
+// binaryJSON returns the JSON record of a match in a binary file
+func binaryJSON(result Result) jsonBinary {
+    return jsonBinary{Type: "binary", File: result.File, Offset: result.Offset,
+        Text: printable([]byte(result.Text)), Hex: hex.EncodeToString([]byte(result.Text)),
+        DumpOffset: result.DumpOffset, Dump: hex.EncodeToString(result.Dump)}
+}
@@ -0,0 +1,60 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "testing"
+)
+
+// The matches across the chunks of a binary file are found once, with
+// their dumps aligned to the offsets in the file
+func TestBinaryChunks(t *testing.T) {
+    pat := setOptions(t, "--binary-offsets", "needle")
+    data := make([]byte, 64<<10)
+    // The chunks aren't a multiple of 16, the first one ends at 20001
+    offsets := []int64{3, 997, 15900, 19990, 19999, 28670, 40001, 65530}
+    for _, offset := range offsets {
+        copy(data[offset:], "needle")
+    }
+    found := make(chan Result)
+    var results []Result
+    go func() {
+        defer close(found)
+        if _, err := (Job{fname: "bin", opts: pat.opts}).scanBinary(context.Background(), bytes.NewReader(data),
+            pat, 20001, found); err != nil {
+            t.Error(err)
+        }
+    }()
+    for result := range found {
+        results = append(results, result)
+    }
+    if len(results) != len(offsets) {
+        t.Fatalf("got %d matches, want %d", len(results), len(offsets))
+    }
+    for i, result := range results {
+        if result.Offset != offsets[i] || result.Text != "needle" {
+            t.Errorf("got %q at %d, want needle at %d", result.Text, result.Offset, offsets[i])
+        }
+        if result.DumpOffset%16 != 0 || result.DumpOffset > result.Offset-min(result.Offset, dumpContext) {
+            t.Errorf("match at %d: dump at %d", result.Offset, result.DumpOffset)
+        }
+        at := result.Offset - result.DumpOffset
+        if !bytes.HasPrefix(result.Dump[at:], []byte("needle")) {
+            t.Errorf("match at %d: dump %q", result.Offset, result.Dump)
+        }
+    }
+}
+
+// Anchors and word boundaries would match at the ends of the chunks
+func TestBinaryAnchors(t *testing.T) {
+    opts := DefaultOptions()
+    opts.BinaryOffsets = true
+    for _, expr := range []string{"^needle", "needle$", `\bneedle`, `(?m)^needle`, `\Aneedle`, `needle\B`} {
+        if _, err := Compile(opts, expr); err == nil {
+            t.Errorf("%s: accepted with --binary-offsets", expr)
+        }
+    }
+    if _, err := Compile(opts, "ne+dle"); err != nil {
+        t.Errorf("ne+dle: %v", err)
+    }
+}
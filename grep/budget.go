@@ -0,0 +1,162 @@
+package grep
+
+import (
+    "context"
+    "sync"
+)
+
+// budget caps the number of bytes held in flight by the workers and
+// the collector. Buffers a worker holds on its own are taken with Hold,
+// results handed on to the collector with Acquire. Acquire blocks while
+// the budget is spent, which slows the workers down until the collector
+// has caught up.
+// For sorted output the collector holds back the results of later files
+// in a reorder buffer, until the file at the head of the output is done.
+// A nil budget has no limit.
+type budget struct {
+    mu       sync.Mutex
+    cond     *sync.Cond
+    limit    int64
+    used     int64 // all bytes in flight
+    queued   int64 // bytes on their way to the collector
+    buffered int64 // bytes in the reorder buffer of the collector
+    head     int   // the sequence number of the file printed next
+}
+
+// newBudget returns a budget of limit bytes, or nil for no limit
+func newBudget(limit int64) *budget {
+    if limit <= 0 {
+        return nil
+    }
+    b := &budget{limit: limit}
+    b.cond = sync.NewCond(&b.mu)
+    return b
+}
+
+// Acquire waits until n bytes fit into the budget and takes them for
+// a result of the file with sequence number seq. Only the collector
+// gives bytes back, so a request is granted anyway once nothing is on
+// its way there, otherwise it could wait forever. The reorder buffer
+// only empties when the file at the head is done, so that file gets its
+// bytes regardless of the buffer, while all others wait for it.
+// It returns false, if the context is done first.
+func (b *budget) Acquire(ctx context.Context, n int64, seq int) bool {
+    if b == nil {
+        return true
+    }
+    stop := context.AfterFunc(ctx, func() {
+        b.mu.Lock()
+        b.cond.Broadcast()
+        b.mu.Unlock()
+    })
+    defer stop()
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for b.used+n > b.limit && (b.queued > 0 || b.buffered > 0 && seq != b.head) {
+        if ctx.Err() != nil {
+            return false
+        }
+        b.cond.Wait()
+    }
+    b.used += n
+    b.queued += n
+    return true
+}
+
+// Release gives back n bytes taken by Acquire
+func (b *budget) Release(n int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.used -= n
+    b.queued -= n
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// Buffer moves n bytes taken by Acquire into the reorder buffer
+func (b *budget) Buffer(n int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.queued -= n
+    b.buffered += n
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// Flush gives back n bytes printed from the reorder buffer
+func (b *budget) Flush(n int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.used -= n
+    b.buffered -= n
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// Advance makes seq the file at the head of the output
+func (b *budget) Advance(seq int) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.head = seq
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// Hold takes n bytes for a buffer without waiting: the worker needs the
+// buffer to make progress at all. The buffer sizes are chosen to leave
+// room for the results.
+func (b *budget) Hold(n int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.used += n
+    b.mu.Unlock()
+}
+
+// Drop gives back n bytes taken by Hold
+func (b *budget) Drop(n int64) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.used -= n
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// bufferSize picks the read buffer size of a worker: the default size
+// with no budget, otherwise a share of the budget, so that all workers
+// together use at most half of it for buffering.
+func (b *budget) bufferSize(workers int) int {
+    const minSize, defaultSize, maxSize = 4 << 10, 64 << 10, 1 << 20
+    if b == nil {
+        return defaultSize
+    }
+    size := b.limit / int64(2*workers)
+    if size < minSize {
+        return minSize
+    }
+    if size > maxSize {
+        return maxSize
+    }
+    return int(size)
+}
+
+// mapLimit is the size of the largest file a worker may map into memory
+func (b *budget) mapLimit(workers int) int64 {
+    const maxSize = 1 << 30
+    if b == nil {
+        return maxSize
+    }
+    return min(b.limit/int64(2*workers), maxSize)
+}
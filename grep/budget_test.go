@@ -0,0 +1,113 @@
+package grep
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "testing"
+    "testing/fstest"
+    "time"
+)
+
+// acquired runs Acquire in the background, and returns its answer on
+// the channel
+func acquired(ctx context.Context, b *budget, n int64, seq int) <-chan bool {
+    granted := make(chan bool, 1)
+    go func() { granted <- b.Acquire(ctx, n, seq) }()
+    return granted
+}
+
+// waiting reports whether the request is still waiting after a while
+func waiting(granted <-chan bool) bool {
+    select {
+    case <-granted:
+        return false
+    case <-time.After(20 * time.Millisecond):
+        return true
+    }
+}
+
+func TestBudgetBackpressure(t *testing.T) {
+    ctx := context.Background()
+    b := newBudget(100)
+    if !b.Acquire(ctx, 80, 0) {
+        t.Fatal("the first request was refused")
+    }
+    // The collector gives the bytes back, the next result waits for it
+    granted := acquired(ctx, b, 40, 0)
+    if !waiting(granted) {
+        t.Fatal("a request beyond the budget was granted")
+    }
+    b.Release(80)
+    if !<-granted {
+        t.Fatal("the request was refused after the release")
+    }
+    // With nothing on its way to the collector, waiting wouldn't end
+    b.Release(40)
+    if !b.Acquire(ctx, 500, 0) {
+        t.Fatal("a large result was refused with nothing queued")
+    }
+}
+
+func TestBudgetCancel(t *testing.T) {
+    b := newBudget(100)
+    b.Acquire(context.Background(), 100, 0)
+    ctx, cancel := context.WithCancel(context.Background())
+    granted := acquired(ctx, b, 1, 0)
+    cancel()
+    if <-granted {
+        t.Fatal("a cancelled request was granted")
+    }
+}
+
+// The file at the head of the output gets its bytes, while the later
+// ones wait for it to get out of the reorder buffer
+func TestBudgetReorder(t *testing.T) {
+    ctx := context.Background()
+    b := newBudget(100)
+    b.Acquire(ctx, 100, 1)
+    b.Buffer(100)
+    later := acquired(ctx, b, 10, 2)
+    if !waiting(later) {
+        t.Fatal("a later file got bytes beyond the budget")
+    }
+    if !<-acquired(ctx, b, 10, 0) {
+        t.Fatal("the head file was refused")
+    }
+    b.Release(10)
+    b.Advance(1)
+    b.Flush(100)
+    if !<-later {
+        t.Fatal("the later file was refused after the flush")
+    }
+}
+
+// A search with a tight budget is slower, but finds everything, also
+// when the results are sorted
+func TestBudgetSearch(t *testing.T) {
+    fsys := fstest.MapFS{}
+    lines := strings.Repeat("foo "+strings.Repeat("x", 200)+"\n", 50)
+    for i := 0; i < 20; i++ {
+        fsys[fmt.Sprintf("f%02d.txt", i)] = &fstest.MapFile{Data: []byte(lines)}
+    }
+    for _, args := range [][]string{
+        {"-r", "--max-memory", "1K", "foo"},
+        {"-r", "--max-memory", "1K", "--sort", "path", "foo"},
+        {"-r", "--max-memory", "1K", "-C", "1", "foo"},
+    } {
+        pat := setOptions(t, args...)
+        results, err := searchResults(t, fsys, pat, ".")
+        if err != nil {
+            t.Fatal(err)
+        }
+        matches := 0
+        for _, result := range results {
+            if result.Text != "" && !result.Context {
+                matches++
+            }
+        }
+        if matches != 20*50 {
+            t.Errorf("%q: got %d matches, want %d", args, matches, 20*50)
+        }
+    }
+}
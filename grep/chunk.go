@@ -0,0 +1,106 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "io"
+)
+
+// scanChunks is the fast path for -c and -l. Instead of splitting the
+// file into lines, it runs the multi-line regexp over large chunks that
+// end on a line boundary, and only looks at the line around a match to
+// confirm it. Line numbers are never needed, so newlines aren't counted.
+func (job Job) scanChunks(ctx context.Context, file io.Reader, pat *Pattern,
+    size int, found chan<- Result) (int, error) {
+    count := 0
+    buf := make([]byte, size)
+    grown := 0
+    defer func() { job.memory.Drop(int64(grown)) }()
+
+    carry := 0
+    for ctx.Err() == nil {
+        start := job.opts.Stats.now()
+        n, err := io.ReadFull(file, buf[carry:])
+        job.opts.Stats.add(readStage, start)
+        job.opts.Stats.read(n)
+        eof := err == io.EOF || err == io.ErrUnexpectedEOF
+        data := buf[:carry+n]
+        if allowed := job.scanned.take(n); allowed < n {
+            // The whole lines that may be scanned are the last chunk
+            data, eof = wholeLines(buf[:carry+allowed]), true
+        }
+        if err != nil && !eof {
+            return count, err
+        }
+
+        // Only search whole lines, the rest is carried over to the next chunk
+        end := len(data)
+        if !eof {
+            i := bytes.LastIndexByte(data, '\n')
+            if i < 0 {
+                // A single line fills the buffer, so make it bigger
+                job.memory.Hold(int64(len(buf)))
+                grown += len(buf)
+                buf = append(buf, make([]byte, len(buf))...)
+                carry = len(data)
+                continue
+            }
+            end = i + 1
+        }
+
+        start = job.opts.Stats.now()
+        count += countChunk(data[:end], pat, pat.opts.firstMatchOnly())
+        job.opts.Stats.add(matchStage, start)
+        if count > 0 && pat.opts.firstMatchOnly() {
+            return count, nil
+        }
+        if eof {
+            return count, nil
+        }
+        carry = copy(buf, data[end:])
+    }
+    return count, nil
+}
+
+// countChunk counts the lines in chunk the pattern matches, or the
+// matches with --count-matches.
+// The chunk consists of whole lines, the last one may lack its newline.
+// With first set it stops at the first matching line.
+func countChunk(chunk []byte, pat *Pattern, first bool) int {
+    count := 0
+    for pos := 0; pos < len(chunk); {
+        var start int
+        if pat.findFold() {
+            i := pat.fold.index(chunk[pos:])
+            if i < 0 {
+                break
+            }
+            start = pos + i
+        } else {
+            loc := pat.chunkRx.FindIndex(chunk[pos:])
+            if loc == nil {
+                break
+            }
+            start = pos + loc[0]
+            if start == len(chunk) && chunk[start-1] == '\n' {
+                // An empty match after the last newline belongs to no line
+                break
+            }
+        }
+
+        // Confirm the candidate on its own line, then go on with the next
+        lineStart := pos + bytes.LastIndexByte(chunk[pos:start], '\n') + 1
+        lineEnd := len(chunk)
+        if i := bytes.IndexByte(chunk[start:], '\n'); i >= 0 {
+            lineEnd = start + i
+        }
+        if line := bytes.TrimRight(chunk[lineStart:lineEnd], "\r"); pat.match(line) {
+            count += pat.weight(line)
+            if first {
+                break
+            }
+        }
+        pos = lineEnd + 1
+    }
+    return count
+}
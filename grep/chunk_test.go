@@ -0,0 +1,70 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "regexp"
+    "strings"
+    "testing"
+)
+
+// chunkText has the lines the chunk regexps get wrong most easily
+var chunkText = "foo\r\n\nbar foo\nxfoo\n\nfoo bar baz\nFOO\n12 34\ncafé\n" +
+    strings.Repeat("long line ", 20) + "foo\nlast foo"
+
+// lineCount counts the lines of text expr matches, or its non-empty
+// matches with countAll, one line at a time
+func lineCount(expr, text string, countAll bool) int {
+    rx := regexp.MustCompile(expr)
+    count := 0
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimRight(line, "\r")
+        if !countAll {
+            if rx.MatchString(line) {
+                count++
+            }
+            continue
+        }
+        for _, loc := range rx.FindAllStringIndex(line, -1) {
+            if loc[0] != loc[1] {
+                count++
+            }
+        }
+    }
+    return count
+}
+
+func TestCountChunk(t *testing.T) {
+    exprs := []string{"foo", "^foo", "foo$", "^$", "f.o", "(?i)foo", "x*", `\bbar\b`,
+        "[0-9]+", "é", "^", "o", "foo|bar", "(?m)^b"}
+    for _, expr := range exprs {
+        for _, countAll := range []bool{false, true} {
+            args := []string{"-c", expr}
+            if countAll {
+                args = []string{"--count-matches", expr}
+            }
+            pat := setOptions(t, args...)
+            if pat.chunkRx == nil {
+                // Searched line by line anyway
+                continue
+            }
+            want := lineCount(expr, chunkText, countAll)
+            if got := countChunk([]byte(chunkText), pat, false); got != want {
+                t.Errorf("%q: got %d, want %d", args, got, want)
+            }
+            // The buffer grows for the long line
+            job := Job{fname: "chunks", opts: pat.opts}
+            got, err := job.scanChunks(context.Background(), bytes.NewReader([]byte(chunkText)), pat, 16, nil)
+            if err != nil || got != want {
+                t.Errorf("%q in chunks of 16: got %d, %v, want %d", args, got, err, want)
+            }
+        }
+    }
+}
+
+func TestCountChunkFirst(t *testing.T) {
+    pat := setOptions(t, "-l", "foo")
+    if got := countChunk([]byte(chunkText), pat, true); got != 1 {
+        t.Errorf("got %d, want 1", got)
+    }
+}
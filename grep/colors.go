@@ -0,0 +1,155 @@
+package grep
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// colorTheme holds the SGR sequences for the parts of the output,
+// an empty sequence leaves the part uncolored
+type colorTheme struct {
+    match string // ms: the matching text
+    fname string // fn: file names
+    lino  string // ln: line numbers
+    sep   string // se: the separators
+
+    // The colors of the matches of several -e patterns or --preset rules,
+    // used round-robin
+    patterns []string
+}
+
+// The colors of GNU grep
+var defaultTheme = colorTheme{match: "01;31", fname: "35", lino: "32", sep: "36"}
+
+// The colors of the patterns after the first one, which has the match color
+var patternPalette = []string{"01;32", "01;33", "01;34", "01;36", "01;35"}
+
+// setupColors builds the theme of a colored output from the defaults,
+// GREP_COLORS and --colors, in that order
+func setupColors(opts *Options) error {
+    opts.theme = nil
+    if !opts.Color {
+        return nil
+    }
+
+    t := defaultTheme
+    // Like grep, we quietly ignore what we don't understand in the environment
+    parseColors(os.Getenv("GREP_COLORS"), &t)
+    if err := parseColors(opts.Colors, &t); err != nil {
+        return err
+    }
+    if opts.PatternColors != "" {
+        for _, sgr := range strings.Split(opts.PatternColors, ",") {
+            if strings.Trim(sgr, "0123456789;") != "" {
+                return fmt.Errorf("invalid pattern color: %s", sgr)
+            }
+            t.patterns = append(t.patterns, sgr)
+        }
+    } else {
+        t.patterns = append([]string{t.match}, patternPalette...)
+    }
+    opts.theme = &t
+    return nil
+}
+
+// parseColors sets the theme from the capabilities in spec, which has
+// the GREP_COLORS syntax, e.g. "ms=01;31:fn=35:ln=32:se=36".
+// mt sets the match color like ms, the capabilities of GNU grep we
+// don't use are ignored, anything else is an error. The valid
+// capabilities are applied anyway, the first error is returned.
+func parseColors(spec string, t *colorTheme) error {
+    var err error
+    for _, capability := range strings.Split(spec, ":") {
+        if capability == "" {
+            continue
+        }
+        name, value, _ := strings.Cut(capability, "=")
+        if strings.Trim(value, "0123456789;") != "" {
+            if err == nil {
+                err = fmt.Errorf("invalid color: %s", capability)
+            }
+            continue
+        }
+        switch name {
+        case "ms", "mt":
+            t.match = value
+        case "fn":
+            t.fname = value
+        case "ln":
+            t.lino = value
+        case "se":
+            t.sep = value
+        case "mc", "sl", "cx", "bn", "rv", "ne":
+        default:
+            if err == nil {
+                err = fmt.Errorf("invalid color capability: %s", name)
+            }
+        }
+    }
+    return err
+}
+
+// paint wraps s in the SGR sequence sgr
+func paint(sgr, s string) string {
+    if sgr == "" || s == "" {
+        return s
+    }
+    return "\x1b[" + sgr + "m\x1b[K" + s + "\x1b[m\x1b[K"
+}
+
+// colorFname colors a file name, if the output is colored
+func (t *colorTheme) colorFname(fname string) string {
+    if t == nil {
+        return fname
+    }
+    return paint(t.fname, fname)
+}
+
+// colorLino colors a line number, if the output is colored
+func (t *colorTheme) colorLino(lino int) string {
+    if t == nil {
+        return fmt.Sprint(lino)
+    }
+    return paint(t.lino, fmt.Sprint(lino))
+}
+
+// colorSep colors a separator, if the output is colored
+func (t *colorTheme) colorSep(sep string) string {
+    if t == nil {
+        return sep
+    }
+    return paint(t.sep, sep)
+}
+
+// highlight colors every match of pat in line, if the output is colored.
+// The matches of several patterns get the colors of their patterns.
+func highlight(line string, pat *Pattern) string {
+    if pat.opts.theme == nil || pat.opts.theme.match == "" {
+        return line
+    }
+    var b strings.Builder
+    last := 0
+    for _, loc := range pat.findAll(line, -1) {
+        if loc[0] == loc[1] {
+            continue
+        }
+        b.WriteString(line[last:loc[0]])
+        b.WriteString(paint(matchColor(pat, loc), line[loc[0]:loc[1]]))
+        last = loc[1]
+    }
+    b.WriteString(line[last:])
+    return b.String()
+}
+
+// matchColor returns the color of the match with the submatch indexes
+// loc, the one of its pattern, if there are several
+func matchColor(pat *Pattern, loc []int) string {
+    if len(pat.rules) < 2 || len(pat.opts.theme.patterns) == 0 {
+        return pat.opts.theme.match
+    }
+    if i := pat.ruleOf(loc); i > 0 {
+        return pat.opts.theme.patterns[(i-1)%len(pat.opts.theme.patterns)]
+    }
+    return pat.opts.theme.match
+}
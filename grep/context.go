@@ -0,0 +1,83 @@
+package grep
+
+import (
+    "context"
+)
+
+// withContext reports whether the lines around the matches are printed,
+// with --passthru all of them. The count modes and -o print no context.
+func (opts *Options) withContext() bool {
+    return (opts.After > 0 || opts.Before > 0 || opts.Passthru) &&
+        !opts.CountOnly && !opts.FilesOnly && !opts.OnlyMatching
+}
+
+// lineContext keeps track of the context lines of a file for -A and -B
+type lineContext struct {
+    before []contextLine // the last lines, for the next match
+    after  int           // the lines still to send after the last match
+}
+
+// contextLine is a line kept for the next match
+type contextLine struct {
+    lino int
+    line []byte
+}
+
+// newLineContext returns the context of a file, or nil if there is
+// no context to print
+func newLineContext(opts *Options) *lineContext {
+    if !opts.withContext() {
+        return nil
+    }
+    return &lineContext{before: make([]contextLine, 0, opts.Before)}
+}
+
+// match sends the lines kept before a match. It returns false, if the
+// context is done.
+func (c *lineContext) match(ctx context.Context, job Job, found chan<- Result) bool {
+    for _, kept := range c.before {
+        if !job.sendContext(ctx, found, kept.lino, kept.line) {
+            return false
+        }
+    }
+    c.before = c.before[:0]
+    c.after = job.opts.After
+    return true
+}
+
+// other handles a line that doesn't match: it is sent right after
+// a match or with --passthru, and kept for the next match otherwise
+func (c *lineContext) other(ctx context.Context, job Job, found chan<- Result,
+    lino int, line []byte) bool {
+    if job.opts.Passthru {
+        return job.sendContext(ctx, found, lino, line)
+    }
+    if c.after > 0 {
+        c.after--
+        return job.sendContext(ctx, found, lino, line)
+    }
+    if job.opts.Before == 0 {
+        return true
+    }
+    if len(c.before) == job.opts.Before {
+        copy(c.before, c.before[1:])
+        c.before = c.before[:len(c.before)-1]
+    }
+    c.before = append(c.before, contextLine{lino, line})
+    return true
+}
+
+// sendContext sends a context line to the found channel. It returns
+// false, if the context is done.
+func (job Job) sendContext(ctx context.Context, found chan<- Result, lino int, line []byte) bool {
+    if !job.memory.Acquire(ctx, int64(len(line)), job.seq) {
+        return false
+    }
+    select {
+    case found <- Result{File: job.fname, Line: lino, Text: string(line), Context: true}:
+        return true
+    case <-ctx.Done():
+        job.memory.Release(int64(len(line)))
+        return false
+    }
+}
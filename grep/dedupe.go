@@ -0,0 +1,190 @@
+package grep
+
+import (
+    "context"
+    "crypto/sha256"
+    "io"
+    "io/fs"
+    "sync"
+    "sync/atomic"
+)
+
+// dedupePaths passes on only the first of the files with the same
+// contents for --dedupe-content, until the context is done. The others
+// are returned as the aliases of the first one, which are complete
+// before the first file is sent. Only files of the same size are
+// hashed, so that most files are read just once, by the workers.
+// The aliases of --dedupe-links, if any, are taken over. The files left
+// out are counted in dropped.
+func dedupePaths(ctx context.Context, fsys fs.FS, paths <-chan string, aliases map[string][]string,
+    opts *Options, dropped *atomic.Int64) (<-chan string, map[string][]string) {
+    unique := make(chan string, opts.workers())
+    if aliases == nil {
+        aliases = make(map[string][]string)
+    }
+    go func() {
+        defer close(unique)
+        var fnames []string
+        bySize := make(map[int64][]string)
+        for path := range paths {
+            fnames = append(fnames, path)
+            if info, err := statPath(fsys, path); err == nil && info.Mode().IsRegular() {
+                bySize[info.Size()] = append(bySize[info.Size()], path)
+            }
+        }
+
+        sums := hashFiles(ctx, fsys, bySize, opts)
+        first := make(map[[sha256.Size]byte]string)
+        for _, fname := range fnames {
+            sum, ok := sums[fname]
+            if !ok {
+                continue
+            }
+            if original, seen := first[sum]; seen {
+                // The hard links of fname go along with it
+                aliases[original] = append(aliases[original], fname)
+                aliases[original] = append(aliases[original], aliases[fname]...)
+                delete(aliases, fname)
+            } else {
+                first[sum] = fname
+            }
+        }
+
+        for _, fname := range fnames {
+            if sum, ok := sums[fname]; ok && first[sum] != fname {
+                dropped.Add(1)
+                continue
+            }
+            select {
+            case unique <- fname:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return unique, aliases
+}
+
+// dedupeLinkPaths passes on only the first of the paths of a hard-linked
+// file for --dedupe-links, until the context is done. With "first" the
+// other paths are left out as they come, with "all" they are returned as
+// the aliases of the first one, which needs the whole walk before the
+// first path is sent, like --dedupe-content. The paths left out are
+// counted in dropped.
+func dedupeLinkPaths(ctx context.Context, fsys fs.FS, paths <-chan string, opts *Options,
+    dropped *atomic.Int64) (<-chan string, map[string][]string) {
+    unique := make(chan string, opts.workers())
+    aliases := make(map[string][]string)
+    go func() {
+        defer close(unique)
+        first := make(map[fileKey]string)
+        var fnames []string
+        for path := range paths {
+            if key, ok := linkKeyOf(fsys, path); ok {
+                if original, seen := first[key]; seen {
+                    if opts.DedupeLinks == "all" {
+                        aliases[original] = append(aliases[original], path)
+                    }
+                    dropped.Add(1)
+                    continue
+                }
+                first[key] = path
+            }
+            if opts.DedupeLinks == "all" {
+                fnames = append(fnames, path)
+                continue
+            }
+            select {
+            case unique <- path:
+            case <-ctx.Done():
+                return
+            }
+        }
+        for _, fname := range fnames {
+            select {
+            case unique <- fname:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    if opts.DedupeLinks == "first" {
+        return unique, nil
+    }
+    return unique, aliases
+}
+
+// hashFiles hashes the contents of the files that share their size with
+// another one, in parallel. Files that can't be read are left out, the
+// workers report them.
+func hashFiles(ctx context.Context, fsys fs.FS, bySize map[int64][]string, opts *Options) map[string][sha256.Size]byte {
+    todo := make(chan string)
+    sums := make(map[string][sha256.Size]byte)
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for i := 0; i < opts.workers(); i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for fname := range todo {
+                if sum, err := hashFile(ctx, fsys, fname, opts.diskRate); err == nil {
+                    mu.Lock()
+                    sums[fname] = sum
+                    mu.Unlock()
+                }
+            }
+        }()
+    }
+    for _, fnames := range bySize {
+        if len(fnames) < 2 {
+            continue
+        }
+        for _, fname := range fnames {
+            if ctx.Err() == nil {
+                todo <- fname
+            }
+        }
+    }
+    close(todo)
+    wg.Wait()
+    return sums
+}
+
+// hashFile returns the SHA-256 of the contents of fname, read at the
+// --io-limit rate
+func hashFile(ctx context.Context, fsys fs.FS, fname string, rate *ioLimit) ([sha256.Size]byte, error) {
+    var sum [sha256.Size]byte
+    file, release, err := openPath(ctx, fsys, fname)
+    if err != nil {
+        return sum, err
+    }
+    defer release()
+    defer file.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, rate.reader(ctx, file)); err != nil {
+        return sum, err
+    }
+    copy(sum[:], h.Sum(nil))
+    return sum, nil
+}
+
+// replay sends the results of the job again for each of its aliases,
+// which have the same contents. It returns false, if the context is
+// done first.
+func (job Job) replay(ctx context.Context, kept []Result) bool {
+    for _, alias := range job.aliases {
+        for _, result := range kept {
+            if !job.memory.Acquire(ctx, int64(len(result.Text)), job.seq) {
+                return false
+            }
+            result.File = alias
+            select {
+            case job.results <- result:
+            case <-ctx.Done():
+                job.memory.Release(int64(len(result.Text)))
+                return false
+            }
+        }
+    }
+    return true
+}
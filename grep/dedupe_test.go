@@ -0,0 +1,33 @@
+package grep
+
+import (
+    "context"
+    "testing"
+    "testing/fstest"
+)
+
+// The copies left out are counted in the summary, so that with the
+// files searched they add up to the files found
+func TestDedupeSummary(t *testing.T) {
+    fsys := fstest.MapFS{
+        "a.txt": {Data: []byte("foo\n")},
+        "b.txt": {Data: []byte("foo\n")},
+        "c.txt": {Data: []byte("foo\n")},
+        "d.txt": {Data: []byte("bar foo\n")},
+    }
+    pat := setOptions(t, "-r", "--dedupe-content", "foo")
+    var searched *Summary
+    err := SearchFS(context.Background(), fsys, pat, []string{"."}, func(result Result) error {
+        if result.Summary != nil {
+            searched = result.Summary
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if searched.Files != 2 || searched.Deduplicated != 2 || searched.Matches != 4 {
+        t.Errorf("got %d files, %d deduplicated and %d matches, want 2, 2 and 4",
+            searched.Files, searched.Deduplicated, searched.Matches)
+    }
+}
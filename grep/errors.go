@@ -0,0 +1,141 @@
+package grep
+
+import (
+    "errors"
+    "io/fs"
+    "log"
+    "sort"
+    "syscall"
+)
+
+// FileError describes a file or directory that couldn't be searched.
+// It travels to the collector as a Result, so that --json can put it
+// into the stream of results.
+type FileError struct {
+    File    string
+    Op      string // the failed operation: open, read, readdir, search, ...
+    Errno   int    // the system error number, 0 if there is none
+    Message string // what went wrong, without the file name
+    Text    string // the complete message for the log
+    Dir     bool   // a directory of the walk, the files below it are missing
+}
+
+// The most unreadable directories the summary at the end names
+const maxUnreadable = 10
+
+// dirError is the failure to read a directory of the walk
+type dirError struct {
+    err error
+}
+
+func (e dirError) Error() string { return e.err.Error() }
+
+func (e dirError) Unwrap() error { return e.err }
+
+// newFileError describes err, which happened on fname
+func newFileError(fname string, err error) *FileError {
+    fe := &FileError{File: fname, Op: "search", Message: err.Error(), Text: err.Error()}
+    var pathErr *fs.PathError
+    if errors.As(err, &pathErr) {
+        fe.Op, fe.Message = pathErr.Op, pathErr.Err.Error()
+        if pathErr.Path != "" {
+            fe.File = pathErr.Path
+        }
+    }
+    var errno syscall.Errno
+    if errors.As(err, &errno) {
+        fe.Errno = int(errno)
+    }
+    var dirErr dirError
+    fe.Dir = errors.As(err, &dirErr)
+    return fe
+}
+
+// timeoutError describes a file that took too long to search
+func timeoutError(fname string) *FileError {
+    return &FileError{File: fname, Op: "search", Message: "timed out",
+        Text: fname + ": search timed out"}
+}
+
+// logError writes an error to the log, unless -s is given. The
+// unreadable directories are only summed up at the end.
+func (opts *Options) logError(fe *FileError) {
+    if opts.NoMessages || fe.Dir {
+        return
+    }
+    log.Printf("error: %s\n", fe.Text)
+}
+
+// logUnreadable writes the directories that couldn't be read to the log,
+// unless -s is given
+func (opts *Options) logUnreadable(s *Summary) {
+    if opts.NoMessages || len(s.dirs) == 0 {
+        return
+    }
+    sort.Slice(s.dirs, func(i, j int) bool { return s.dirs[i].File < s.dirs[j].File })
+    log.Printf("error: %d directories couldn't be read, the files below them weren't searched:\n", len(s.dirs))
+    for _, fe := range s.dirs[:min(len(s.dirs), maxUnreadable)] {
+        log.Printf("error:   %s: %s\n", fe.File, fe.Message)
+    }
+    if len(s.dirs) > maxUnreadable {
+        log.Printf("error:   and %d more\n", len(s.dirs)-maxUnreadable)
+    }
+}
+
+// Summary sums up a search for the end of the --json stream
+type Summary struct {
+    Files        int            // the files searched
+    Deduplicated int            // the copies of them left out by --dedupe-links and --dedupe-content
+    Matches      int            // the matching lines, or matches with -o and --count-matches
+    Errors       map[string]int // the number of errors by message
+    // Whether --max-bytes-scanned stopped the search
+    Truncated bool
+    // The directories of the walk that couldn't be read
+    dirs []*FileError
+}
+
+// add counts a result of the search with opts
+func (s *Summary) add(result Result, opts *Options) {
+    switch {
+    case result.done:
+        s.Files++
+    case result.Err != nil:
+        if s.Errors == nil {
+            s.Errors = make(map[string]int)
+        }
+        s.Errors[result.Err.Message]++
+        if result.Err.Dir {
+            s.dirs = append(s.dirs, result.Err)
+        }
+    case result.Context:
+    case opts.CountOnly || opts.FilesOnly:
+        s.Matches += result.Count
+    default:
+        s.Matches++
+    }
+}
+
+// Failures returns the total number of errors
+func (s *Summary) Failures() int {
+    n := 0
+    for _, count := range s.Errors {
+        n += count
+    }
+    return n
+}
+
+// messages returns the error messages, most frequent first
+func (s *Summary) messages() []string {
+    messages := make([]string, 0, len(s.Errors))
+    for message := range s.Errors {
+        messages = append(messages, message)
+    }
+    sort.Slice(messages, func(i, j int) bool {
+        a, b := messages[i], messages[j]
+        if s.Errors[a] != s.Errors[b] {
+            return s.Errors[a] > s.Errors[b]
+        }
+        return a < b
+    })
+    return messages
+}
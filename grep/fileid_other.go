@@ -0,0 +1,37 @@
+//go:build !unix
+
+package grep
+
+import (
+    "io/fs"
+    "path/filepath"
+)
+
+// fileKey identifies a file by its path with all symbolic links resolved
+type fileKey struct {
+    path string
+}
+
+// keyOf returns the key of the file path refers to, following
+// symbolic links. The paths of an fs.FS can't be resolved, its files
+// have no key.
+func keyOf(fsys fs.FS, path string) (fileKey, bool) {
+    if fsys != nil {
+        return fileKey{}, false
+    }
+    resolved, err := filepath.EvalSymlinks(path)
+    if err != nil {
+        return fileKey{}, false
+    }
+    abs, err := filepath.Abs(resolved)
+    if err != nil {
+        return fileKey{}, false
+    }
+    return fileKey{path: abs}, true
+}
+
+// linkKeyOf would return the key of a file with several hard links,
+// which can't be told apart by path
+func linkKeyOf(fsys fs.FS, path string) (fileKey, bool) {
+    return fileKey{}, false
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package grep
+
+import (
+    "io/fs"
+    "syscall"
+)
+
+// fileKey identifies a file by its device and inode numbers
+type fileKey struct {
+    dev uint64
+    ino uint64
+}
+
+// keyOf returns the key of the file path refers to, following
+// symbolic links. The files of an fs.FS have a key, if its FileInfo
+// comes from the system, like that of os.DirFS.
+func keyOf(fsys fs.FS, path string) (fileKey, bool) {
+    info, err := statPath(fsys, path)
+    if err != nil {
+        return fileKey{}, false
+    }
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return fileKey{}, false
+    }
+    return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// linkKeyOf returns the key of the file path refers to, if it has more
+// than one hard link
+func linkKeyOf(fsys fs.FS, path string) (fileKey, bool) {
+    info, err := statPath(fsys, path)
+    if err != nil {
+        return fileKey{}, false
+    }
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok || st.Nlink < 2 || !info.Mode().IsRegular() {
+        return fileKey{}, false
+    }
+    return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package grep
+
+import (
+    "syscall"
+    "testing"
+    "testing/fstest"
+)
+
+// The hard links of an fs.FS are told by its FileInfo, not by the
+// files of the same names in the working directory
+func TestDedupeLinksFS(t *testing.T) {
+    link := &syscall.Stat_t{Dev: 1, Ino: 7, Nlink: 2}
+    fsys := fstest.MapFS{
+        "a.txt": {Data: []byte("foo\n"), Sys: link},
+        "b.txt": {Data: []byte("foo\n"), Sys: link},
+        "c.txt": {Data: []byte("foo\n"), Sys: &syscall.Stat_t{Dev: 1, Ino: 8, Nlink: 1}},
+    }
+    pat := setOptions(t, "-r", "--dedupe-links", "first", "foo")
+    results, err := searchResults(t, fsys, pat, ".")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := matchedLines(results), []string{"a.txt:foo", "c.txt:foo"}; !equalLines(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+}
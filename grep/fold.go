@@ -0,0 +1,81 @@
+package grep
+
+import (
+    "strings"
+    "unicode/utf8"
+)
+
+// lowerASCII maps the ASCII upper case letters to lower case,
+// and every other byte to itself
+var lowerASCII [256]byte
+
+func init() {
+    for i := range lowerASCII {
+        lowerASCII[i] = byte(i)
+        if 'A' <= i && i <= 'Z' {
+            lowerASCII[i] = byte(i) + 'a' - 'A'
+        }
+    }
+}
+
+// foldFinder is the fast path of -i -F for ASCII literals: a
+// Boyer-Moore-Horspool search that folds the case of the text through
+// a byte table, instead of running a (?i) regexp.
+type foldFinder struct {
+    pattern []byte   // the literal in lower case
+    skip    [256]int // how far to move on, by the last byte tried
+    // Case folding in Go's regexps also matches k with the Kelvin
+    // sign and s with the long s, so for such literals lines with
+    // other than ASCII characters need the regexp
+    unicode bool
+}
+
+// newFoldFinder returns the finder for lit, or nil if lit isn't ASCII
+func newFoldFinder(lit string) *foldFinder {
+    if lit == "" || strings.ContainsAny(lit, "\r\n") {
+        return nil
+    }
+    f := &foldFinder{pattern: make([]byte, len(lit))}
+    for i := 0; i < len(lit); i++ {
+        if lit[i] >= utf8.RuneSelf {
+            return nil
+        }
+        f.pattern[i] = lowerASCII[lit[i]]
+    }
+    f.unicode = strings.ContainsAny(string(f.pattern), "ks")
+
+    m := len(f.pattern)
+    for i := range f.skip {
+        f.skip[i] = m
+    }
+    for i := 0; i < m-1; i++ {
+        f.skip[f.pattern[i]] = m - 1 - i
+    }
+    return f
+}
+
+// index returns the offset of the first occurrence of the literal in
+// data, ignoring ASCII case, or -1
+func (f *foldFinder) index(data []byte) int {
+    m := len(f.pattern)
+    for i := 0; i+m <= len(data); i += f.skip[lowerASCII[data[i+m-1]]] {
+        j := m - 1
+        for j >= 0 && lowerASCII[data[i+j]] == f.pattern[j] {
+            j--
+        }
+        if j < 0 {
+            return i
+        }
+    }
+    return -1
+}
+
+// isASCII reports whether data consists of ASCII characters only
+func isASCII(data []byte) bool {
+    for _, c := range data {
+        if c >= utf8.RuneSelf {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,118 @@
+package grep
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+)
+
+// SearchFS searches the files below the roots in an fs.FS like grep does
+// on disk, so that embedded assets, zip archives or an fstest.MapFS can
+// be searched too. Its paths are slash-separated and unrooted, like
+// "docs/index.md", as io/fs wants them. The files of an fs.FS have no
+// descriptors, they are read as streams: there is no mmap strategy, no
+// --pre and no prefetching, and symbolic links aren't followed. The
+// functions here take the fs.FS of the search, nil for the file system
+// of the operating system.
+
+// statPath returns the FileInfo of the file searched as name
+func statPath(fsys fs.FS, name string) (fs.FileInfo, error) {
+    if fsys != nil {
+        return fs.Stat(fsys, name)
+    }
+    return os.Stat(OSPath(name))
+}
+
+// joinPath joins the name of a directory entry to the directory
+func joinPath(fsys fs.FS, dir, name string) string {
+    if fsys != nil {
+        return path.Join(dir, name)
+    }
+    return filepath.Join(dir, name)
+}
+
+// readFile returns the contents of a small file, e.g. a .gitignore
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+    if fsys != nil {
+        return fs.ReadFile(fsys, name)
+    }
+    return os.ReadFile(OSPath(name))
+}
+
+// openPath opens name in a free slot like openFile, in fsys if it isn't
+// nil
+func openPath(ctx context.Context, fsys fs.FS, name string) (fs.File, func(), error) {
+    if fsys == nil {
+        return openFile(ctx, name)
+    }
+    if !acquireOpen(ctx) {
+        return nil, nil, ctx.Err()
+    }
+    file, err := fsys.Open(name)
+    if err != nil {
+        releaseOpen()
+        return nil, nil, err
+    }
+    return file, releaseOpen, nil
+}
+
+// searchFile searches a file of job.fsys. What search learns from the
+// first bytes of a file on disk is peeked from the buffered stream.
+func (job Job) searchFile(ctx context.Context, pat *Pattern, found chan<- Result) error {
+    done := job.progress.wait()
+    file, release, err := openPath(ctx, job.fsys, job.fname)
+    done()
+    if err != nil {
+        return err
+    }
+    defer release()
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    reader := bufio.NewReaderSize(file, binarySniffSize)
+    if job.opts.mime != nil && info.Mode().IsRegular() {
+        head, err := peekHead(reader, sniffSize)
+        if err != nil {
+            return &fs.PathError{Op: "read", Path: job.fname, Err: err}
+        }
+        if !job.opts.mimeAllowed(detectType(head)) {
+            return nil
+        }
+    }
+    if job.opts.BinaryOffsets && !job.opts.CountOnly && !job.opts.FilesOnly && info.Mode().IsRegular() {
+        head, err := peekHead(reader, binarySniffSize)
+        if err != nil {
+            return &fs.PathError{Op: "read", Path: job.fname, Err: err}
+        }
+        if bytes.IndexByte(head, 0) >= 0 {
+            job.opts.Stats.file()
+            _, err := job.scanBuffered(ctx, reader, pat, found, job.scanBinary)
+            return err
+        }
+    }
+
+    job.opts.Stats.file()
+    count, err := job.scanStream(ctx, reader, pat, found)
+    if err != nil || ctx.Err() != nil {
+        return err
+    }
+    job.sendCount(ctx, found, count)
+    return nil
+}
+
+// peekHead returns the first n bytes of the stream, or all of a shorter one
+func peekHead(reader *bufio.Reader, n int) ([]byte, error) {
+    head, err := reader.Peek(n)
+    if err == io.EOF {
+        err = nil
+    }
+    return head, err
+}
@@ -0,0 +1,161 @@
+package grep
+
+import (
+    "fmt"
+    "slices"
+    "testing"
+    "testing/fstest"
+)
+
+// testFS is a small tree with ignore rules and a binary file
+var testFS = fstest.MapFS{
+    "a.txt":          {Data: []byte("foo\nbar\nfoo2\n")},
+    "bin":            {Data: []byte("foo\x00foo\n")},
+    "sub/b.txt":      {Data: []byte("xfoo\nbar\n")},
+    "sub/c.log":      {Data: []byte("foo\n")},
+    "sub/.gitignore": {Data: []byte("*.log\n")},
+    "sub/deep/d.txt": {Data: []byte("no\nfoo\n")},
+    ".git/config":    {Data: []byte("foo\n")},
+}
+
+func TestGrepFS(t *testing.T) {
+    tests := []struct {
+        args  []string
+        roots []string
+        want  []string
+    }{
+        {[]string{"foo"}, []string{"a.txt"}, []string{"a.txt:foo", "a.txt:foo2"}},
+        {[]string{"foo"}, []string{"a.txt", "sub/b.txt"}, []string{"a.txt:foo", "a.txt:foo2", "sub/b.txt:xfoo"}},
+        {[]string{"foo"}, []string{"bin"}, []string{"bin:foo\x00foo"}},
+        {[]string{"--binary-offsets", "foo"}, []string{"bin", "a.txt"}, []string{"bin: binary", "bin: binary", "a.txt:foo", "a.txt:foo2"}},
+        // The walk skips .git and what .gitignore excludes
+        {[]string{"-r", "foo"}, []string{"."}, []string{"a.txt:foo", "a.txt:foo2", "bin:foo\x00foo",
+            "sub/b.txt:xfoo", "sub/deep/d.txt:foo"}},
+        {[]string{"-r", "--no-ignore", "foo"}, []string{"sub"}, []string{"sub/b.txt:xfoo", "sub/c.log:foo",
+            "sub/deep/d.txt:foo"}},
+        {[]string{"-r", "--max-depth", "1", "foo"}, []string{"sub"}, []string{"sub/b.txt:xfoo"}},
+        {[]string{"-r", "-i", "-F", "XFOO"}, []string{"."}, []string{"sub/b.txt:xfoo"}},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.args...)
+        results, err := searchResults(t, testFS, pat, test.roots...)
+        if err != nil {
+            t.Fatalf("%q: %s", test.args, err)
+        }
+        if got := matchedLines(results); !equalLines(got, test.want) {
+            t.Errorf("%q in %q: got %q, want %q", test.args, test.roots, got, test.want)
+        }
+    }
+}
+
+// Two searches of different file systems at the same time each search
+// their own
+func TestGrepFSConcurrent(t *testing.T) {
+    pat := setOptions(t, "-r", "foo")
+    other := fstest.MapFS{
+        "a.txt":   {Data: []byte("other foo\n")},
+        "x/y.txt": {Data: []byte("foo y\n")},
+    }
+    want := [][]string{
+        {"a.txt:foo", "a.txt:foo2", "bin:foo\x00foo", "sub/b.txt:xfoo", "sub/deep/d.txt:foo"},
+        {"a.txt:other foo", "x/y.txt:foo y"},
+    }
+    got := make([][]string, 2)
+    errs := make(chan error, 2)
+    for i, fsys := range []fstest.MapFS{testFS, other} {
+        go func() {
+            results, err := searchResults(t, fsys, pat, ".")
+            got[i] = matchedLines(results)
+            errs <- err
+        }()
+    }
+    for range 2 {
+        if err := <-errs; err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i := range want {
+        if !equalLines(got[i], want[i]) {
+            t.Errorf("search %d: got %q, want %q", i, got[i], want[i])
+        }
+    }
+}
+
+func TestGrepFSCounts(t *testing.T) {
+    pat := setOptions(t, "-r", "-c", "foo")
+    results, err := searchResults(t, testFS, pat, ".")
+    if err != nil {
+        t.Fatal(err)
+    }
+    counts := make(map[string]int)
+    for _, result := range results {
+        if !result.done {
+            counts[result.File] = result.Count
+        }
+    }
+    want := map[string]int{"a.txt": 2, "bin": 1, "sub/b.txt": 1, "sub/deep/d.txt": 1}
+    if len(counts) != len(want) {
+        t.Errorf("got counts %v, want %v", counts, want)
+    }
+    for fname, count := range want {
+        if counts[fname] != count {
+            t.Errorf("%s: got count %d, want %d", fname, counts[fname], count)
+        }
+    }
+}
+
+// The errors of missing files reach the sink, with the name of the
+// file and the failed operation
+func TestGrepFSErrors(t *testing.T) {
+    pat := setOptions(t, "foo")
+    results, err := searchResults(t, testFS, pat, "a.txt", "missing.txt")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var errs []*FileError
+    for _, result := range results {
+        if result.Err != nil {
+            errs = append(errs, result.Err)
+        }
+    }
+    if len(errs) != 1 || errs[0].File != "missing.txt" || errs[0].Op != "open" {
+        t.Fatalf("got errors %+v, want one for opening missing.txt", errs)
+    }
+    if got := matchedLines(results); !equalLines(got, []string{"a.txt:foo", "a.txt:foo2", "missing.txt: " + errs[0].Message}) {
+        t.Errorf("got %q", got)
+    }
+}
+
+// The --line-range counts the lines of the file, whatever the
+// --line-number-start, and the context stays within it
+func TestLineRange(t *testing.T) {
+    fsys := fstest.MapFS{"f.txt": {Data: []byte("foo 1\nbar 2\nfoo 3\nbar 4\nfoo 5\nbar 6\n")}}
+    tests := []struct {
+        args []string
+        want []string
+    }{
+        {[]string{"--line-range", "2:3", "foo"}, []string{"3:foo 3"}},
+        {[]string{"--line-range", "2:3", "--line-number-start", "10", "foo"}, []string{"12:foo 3"}},
+        {[]string{"--line-range", "3:", "--line-number-start", "3", "foo"}, []string{"5:foo 3", "7:foo 5"}},
+        {[]string{"--line-range", "2:4", "-C", "2", "foo"}, []string{"2-bar 2", "3:foo 3", "4-bar 4"}},
+        {[]string{"--line-range", "2:3", "--passthru", "foo"}, []string{"2-bar 2", "3:foo 3"}},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.args...)
+        results, err := searchResults(t, fsys, pat, "f.txt")
+        if err != nil {
+            t.Fatal(err)
+        }
+        var got []string
+        for _, result := range results {
+            sep := ":"
+            if result.Context {
+                sep = "-"
+            }
+            got = append(got, fmt.Sprint(result.Line, sep, result.Text))
+        }
+        if !slices.Equal(got, test.want) {
+            t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+        }
+    }
+}
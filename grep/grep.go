@@ -0,0 +1,631 @@
+// Package grep is the search engine of cgrep, a concurrent grep.
+// Compile a pattern with the Options of the search, and pass the
+// Results of Search on to a Sink: a slow sink slows the search down,
+// a failing one stops it.
+package grep
+
+import (
+    "context"
+    "os"
+    "bufio"
+    "bytes"
+    "io"
+    "io/fs"
+    "runtime/pprof"
+    "strconv"
+    "sync/atomic"
+)
+
+// The Result struct that is returned with every match of the regexp.
+// In the count modes there is one Result per file, holding the count
+// of matching lines. Every job ends with a Result that is marked done.
+// Errors are Results too, and the last Result a sink gets sums up
+// the search.
+type Result struct {
+    File    string
+    seq     int
+    done    bool
+    Err     *FileError
+    Summary *Summary
+    Line    int    // the line number, counting from Options.LineStart
+    Text    string // the line, or the match with -o
+    Count   int
+    Groups  []Group // only for --json and --format
+
+    // The --preset rule or -e pattern that matched, and its index
+    // counting from 1
+    Rule    string
+    Pattern int
+
+    Context bool // a line around a match, not a match
+
+    Column int // of the first match counting from 1, 0 if not known
+
+    // A match in a binary file with --binary-offsets, at Offset, and
+    // the bytes around it from DumpOffset on
+    Binary     bool
+    Offset     int64
+    DumpOffset int64
+    Dump       []byte
+}
+
+// Group is a capture group of the first match in a line,
+// start and end are byte offsets into the line
+type Group struct {
+    Name  string
+    Text  string
+    Start int
+    End   int
+}
+
+// The Job struct holds the filename, its sequence number in the output
+// and the result channel of the current job, and the memory budget
+// and the set of unique matches shared by all jobs
+type Job struct {
+    fname    string
+    fsys     fs.FS // the file system of fname, nil for the one of the system
+    seq      int
+    results  chan<- Result
+    memory   *budget
+    unique   *matchSet    // the matches seen so far with --unique
+    aliases  []string     // the files with the same contents, with --dedupe-content
+    scanned  *scanLimit
+    watch    *watchdog
+    progress *jobProgress // the job as the watchdog sees it
+    opts     *Options     // the options of the search
+}
+
+// Do does the job for one file: matches the regex for each line
+// and returns the result in an channel.
+// Opening and reading happen in a separate goroutine, so that a file
+// that never delivers EOF (a named pipe, a hung network mount) can be
+// abandoned when the context is done.
+func (job Job) Do(ctx context.Context, pat *Pattern) {
+    if job.opts.FileTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, job.opts.FileTimeout)
+        defer cancel()
+    }
+    if job.watch != nil {
+        var abandon context.CancelCauseFunc
+        ctx, abandon = context.WithCancelCause(ctx)
+        defer abandon(nil)
+        job.progress = job.watch.begin(job.fname, abandon)
+        defer job.watch.end(job.progress)
+    }
+
+    // Tell the collector that the file is done, whatever happens
+    defer func() {
+        job.results <- Result{File: job.fname, seq: job.seq, done: true}
+    }()
+
+    found := make(chan Result)
+    failed := make(chan error, 1)
+    go func() {
+        failed <- job.search(ctx, pat, found)
+    }()
+
+    // The results are kept for the aliases
+    var kept []Result
+    var keptBytes int64
+    defer func() { job.memory.Drop(keptBytes) }()
+
+    for {
+        select {
+        case result := <-found:
+            result.seq = job.seq
+            if job.aliases != nil {
+                kept = append(kept, result)
+                keptBytes += int64(len(result.Text))
+                job.memory.Hold(int64(len(result.Text)))
+            }
+            select {
+            case job.results <- result:
+            case <-ctx.Done():
+                job.memory.Release(int64(len(result.Text)))
+                job.cancelled(ctx)
+                return
+            }
+        case err := <-failed:
+            switch {
+            case ctx.Err() != nil:
+                // The search may have given up because of the context
+                job.cancelled(ctx)
+            case err != nil:
+                job.results <- Result{File: job.fname, seq: job.seq, Err: newFileError(job.fname, err)}
+            case job.aliases != nil:
+                job.replay(ctx, kept)
+            }
+            return
+        case <-ctx.Done():
+            job.cancelled(ctx)
+            return
+        }
+    }
+}
+
+// cancelled reports a job whose context is done: when it timed out or
+// the watchdog abandoned it. A cancelled search isn't the file's fault.
+func (job Job) cancelled(ctx context.Context) {
+    switch {
+    case ctx.Err() == context.DeadlineExceeded:
+        job.results <- Result{File: job.fname, seq: job.seq, Err: timeoutError(job.fname)}
+    case context.Cause(ctx) == errStuck:
+        job.results <- Result{File: job.fname, seq: job.seq, Err: stuckError(job.fname, job.progress)}
+    }
+}
+
+// search opens the file and runs the scanner the planner picks for it.
+// It stops as soon as the context is done.
+func (job Job) search(ctx context.Context, pat *Pattern,
+    found chan<- Result) error {
+    if IsURL(job.fname) {
+        return job.searchURL(ctx, pat, found)
+    }
+    if IsStdin(job.fname) {
+        return job.searchStdin(ctx, pat, found)
+    }
+    if job.fsys != nil {
+        return job.searchFile(ctx, pat, found)
+    }
+
+    done := job.progress.wait()
+    file, release, err := openFile(ctx, job.fname)
+    done()
+    if err != nil {
+        return err
+    }
+    defer release()
+    defer file.Close()
+
+    // Closing the file unblocks a pending read on pipes and the like
+    stop := context.AfterFunc(ctx, func() { file.Close() })
+    defer stop()
+
+    info, err := file.Stat()
+    if err != nil {
+        return err
+    }
+    if job.opts.mime != nil && info.Mode().IsRegular() {
+        mimeType, err := sniffType(file)
+        if err != nil {
+            return &fs.PathError{Op: "read", Path: job.fname, Err: err}
+        }
+        if !job.opts.mimeAllowed(mimeType) {
+            return nil
+        }
+    }
+    if job.opts.Pre != "" && info.Mode().IsRegular() {
+        return job.searchPre(ctx, file, pat, found)
+    }
+    if job.opts.BinaryOffsets && !job.opts.CountOnly && !job.opts.FilesOnly && info.Mode().IsRegular() {
+        binary, err := isBinary(file)
+        if err != nil {
+            return &fs.PathError{Op: "read", Path: job.fname, Err: err}
+        }
+        if binary {
+            job.opts.Stats.file()
+            _, err := job.scanBuffered(ctx, file, pat, found, job.scanBinary)
+            return err
+        }
+    }
+    return job.scanFile(ctx, file, info, pat, found)
+}
+
+// scanFile runs the scanner the planner picks for the open file
+func (job Job) scanFile(ctx context.Context, file *os.File, info os.FileInfo, pat *Pattern,
+    found chan<- Result) error {
+    job.opts.Stats.file()
+    var count int
+    var err error
+    switch plan(info, pat, job.memory) {
+    case mmapStrategy:
+        count, err = job.scanMapped(ctx, file, info.Size(), pat, found)
+    case chunkStrategy:
+        count, err = job.scanBuffered(ctx, file, pat, found, job.scanChunks)
+    default:
+        count, err = job.scanBuffered(ctx, file, pat, found, job.scanLines)
+    }
+    if err != nil || ctx.Err() != nil {
+        return err
+    }
+    job.sendCount(ctx, found, count)
+    return nil
+}
+
+// sendCount sends the single result that sums up the file in the
+// count modes, for files without matches only with --include-zero
+func (job Job) sendCount(ctx context.Context, found chan<- Result, count int) {
+    opts := job.opts
+    if !opts.countReported(count) {
+        return
+    }
+    if count > 0 && (opts.CountOnly || opts.FilesOnly) || opts.IncludeZero && opts.CountOnly && !opts.FilesOnly {
+        select {
+        case found <- Result{File: job.fname, Count: count}:
+        case <-ctx.Done():
+        }
+    }
+}
+
+// firstMatchOnly reports whether the scanners may stop at the first
+// match of a file: with -l, unless the thresholds need the whole count
+func (opts *Options) firstMatchOnly() bool {
+    return opts.FilesOnly && opts.MinMatches == 0 && opts.MaxMatches == 0
+}
+
+// countReported reports whether a file with count matching lines is
+// within --files-with-at-least and --files-with-at-most
+func (opts *Options) countReported(count int) bool {
+    return count >= opts.MinMatches && (opts.MaxMatches == 0 || count <= opts.MaxMatches)
+}
+
+// A scanner reads the file through a buffer of the given size,
+// and returns the number of matching lines
+type scanner func(ctx context.Context, file io.Reader, pat *Pattern,
+    size int, found chan<- Result) (int, error)
+
+// scanBuffered runs scan with a read buffer, which counts against
+// the memory budget
+func (job Job) scanBuffered(ctx context.Context, file io.Reader, pat *Pattern,
+    found chan<- Result, scan scanner) (int, error) {
+    size := job.memory.bufferSize(job.opts.workers())
+    job.memory.Hold(int64(size))
+    defer job.memory.Drop(int64(size))
+    return scan(ctx, job.opts.diskRate.reader(ctx, job.progress.reader(file)), pat, size, found)
+}
+
+// scanLines reads the file line by line and sends every matching line
+// to the found channel, or only counts them in the count modes.
+func (job Job) scanLines(ctx context.Context, file io.Reader, pat *Pattern,
+    size int, found chan<- Result) (int, error) {
+    count := 0
+    reader := bufio.NewReaderSize(file, size)
+    around := newLineContext(job.opts)
+    for n := 1; ; n++ {
+        // The --line-range is one of the lines of the file, whatever
+        // the --line-number-start
+        if job.opts.Lines.past(n) {
+            // No need to read the rest of the file
+            return count, nil
+        }
+        start := job.opts.Stats.now()
+        line, err := readRecord(reader, job.opts.delimiter)
+        job.opts.Stats.add(readStage, start)
+        if err == io.EOF && len(line) == 0 {
+            // There is no line after the last newline
+            return count, nil
+        }
+        job.opts.Stats.read(len(line))
+        if job.scanned.take(len(line)) < len(line) {
+            // The rest isn't searched any more
+            return count, nil
+        }
+        line = trimRecord(line, job.opts.delimiter)
+        lino := n + job.opts.LineStart - 1
+
+        // The lines outside the range are no context either
+        if job.opts.Lines.contains(n) {
+            start = job.opts.Stats.now()
+            ok := pat.match(line)
+            job.opts.Stats.add(matchStage, start)
+            if ok {
+                count += pat.weight(line)
+                if around != nil && !around.match(ctx, job, found) {
+                    return count, nil
+                }
+                if !job.matched(ctx, found, pat, lino, line) {
+                    return count, nil
+                }
+            } else if around != nil && !around.other(ctx, job, found, lino, line) {
+                return count, nil
+            }
+        }
+
+        if err != nil {
+            // Normally, we have reached EOF here
+            if err != io.EOF && ctx.Err() == nil {
+                return count, &fs.PathError{Op: "read", Path: job.fname, Err: err}
+            }
+            return count, nil
+        }
+    }
+}
+
+// readRecord reads the next line, or the next record up to and including
+// the --delimiter
+func readRecord(reader *bufio.Reader, delimiter []byte) ([]byte, error) {
+    last := delimiter[len(delimiter)-1]
+    if len(delimiter) == 1 {
+        return reader.ReadBytes(last)
+    }
+    var record []byte
+    for {
+        part, err := reader.ReadBytes(last)
+        record = append(record, part...)
+        if err != nil || bytes.HasSuffix(record, delimiter) {
+            return record, err
+        }
+    }
+}
+
+// unescape replaces the escapes \n, \r, \t, \0 and \\ in s,
+// other backslashes are kept as they are
+func unescape(s string) []byte {
+    escapes := map[byte]byte{'n': '\n', 'r': '\r', 't': '\t', '0': 0, '\\': '\\'}
+    var b []byte
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+1 < len(s) {
+            if c, ok := escapes[s[i+1]]; ok {
+                b = append(b, c)
+                i++
+                continue
+            }
+        }
+        b = append(b, s[i])
+    }
+    return b
+}
+
+// trimRecord cuts the delimiter off a record. Lines lose their \r\n
+// or \n line ends.
+func trimRecord(record, delimiter []byte) []byte {
+    if len(delimiter) == 1 && delimiter[0] == '\n' {
+        return bytes.TrimRight(record, "\n\r")
+    }
+    return bytes.TrimSuffix(record, delimiter)
+}
+
+// matched handles a matching line for the scanners: it sends the line,
+// or with -o each match in it, to the found channel, unless only counts
+// are wanted. It returns false, if the scan should stop.
+func (job Job) matched(ctx context.Context, found chan<- Result, pat *Pattern,
+    lino int, line []byte) bool {
+    switch {
+    case job.opts.firstMatchOnly():
+        // One match is all we need to know
+        return false
+    case job.opts.FilesOnly:
+        return true
+    case job.opts.CountOnly:
+        return true
+    case !job.opts.OnlyMatching:
+        return job.send(ctx, found, pat, lino, line)
+    }
+
+    for _, loc := range pat.lineRx.FindAllIndex(line, -1) {
+        if loc[0] == loc[1] {
+            continue
+        }
+        match := line[loc[0]:loc[1]]
+        if job.unique != nil {
+            // Only the first occurrence is printed, and with --unique-count
+            // none at all, as the counts come at the end
+            if first := job.unique.add(string(match)); !first || job.opts.UniqueCount {
+                continue
+            }
+        }
+        if !job.send(ctx, found, pat, lino, match) {
+            return false
+        }
+    }
+    return true
+}
+
+// send sends text, a matching line or a match in it, to the found
+// channel. It returns false, if the context is done.
+func (job Job) send(ctx context.Context, found chan<- Result, pat *Pattern,
+    lino int, text []byte) bool {
+    // The text is released again by the collector after printing
+    if !job.memory.Acquire(ctx, int64(len(text)), job.seq) {
+        return false
+    }
+    result := Result{File: job.fname, Line: lino, Text: string(text)}
+    if i := pat.rule(result.Text); i > 0 {
+        result.Pattern, result.Rule = i, pat.rules[i-1]
+    }
+    if job.opts.JSON || job.opts.format != nil {
+        result.Groups = captureGroups(pat, result.Text)
+    }
+    select {
+    case found <- result:
+        return true
+    case <-ctx.Done():
+        job.memory.Release(int64(len(text)))
+        return false
+    }
+}
+
+// A Sink receives the results of a search, one at a time. A slow sink
+// slows the workers down, as the results channel fills up. If it returns
+// an error, the search is cancelled and Search returns the error.
+type Sink func(Result) error
+
+// WriterSink returns a sink printing the results to w in the format
+// chosen by the options of pat. It fails with the first write error.
+func WriterSink(w io.Writer, pat *Pattern) Sink {
+    printer := newPrinter(w, pat)
+    return func(result Result) error {
+        return printer.print(result)
+    }
+}
+
+// Search searches the files of the operating system with SearchFS
+func Search(ctx context.Context, pat *Pattern, fnames []string, sink Sink) error {
+    return SearchFS(ctx, nil, pat, fnames, sink)
+}
+
+// SearchFS organizes the work on the files of fsys, nil for the ones of
+// the operating system:
+// Creates the worker jobs, the communication channels
+// and sets the whole machine to work, passing the results to sink
+func SearchFS(ctx context.Context, fsys fs.FS, pat *Pattern, fnames []string, sink Sink) error {
+    opts := pat.opts
+    // A failing sink cancels the search
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    // The end of --max-bytes-scanned only stops feeding the workers,
+    // the files being searched report what was scanned of them
+    feed, stopFeed := context.WithCancel(ctx)
+    defer stopFeed()
+    scanned := newScanLimit(int64(opts.MaxBytesScanned), stopFeed)
+    // watch looks after the files that take long with --watchdog
+    watch := newWatchdog(ctx, opts.Watchdog, opts.WatchdogAbandon)
+
+    // jobs channel is used for passing on jobs, the files queued
+    // there are prefetched with --prefetch
+    jobs := make(chan Job, opts.workers()+opts.Prefetch)
+    var prefetch *prefetcher
+    if fsys == nil {
+        prefetch = newPrefetcher(feed, opts.Prefetch, opts.diskRate)
+    }
+    // results channel is used for collecting results, it is short,
+    // so that the workers can't get far ahead of the sink
+    results := make(chan Result, opts.workers())
+    // done channel is used for signaling that a worker is done with its job
+    done := make(chan struct{}, opts.workers())
+    // memory is the budget for read buffers and pending results
+    memory := newBudget(int64(opts.MaxMemory))
+    // unique collects the distinct matches
+    var unique *matchSet
+    if opts.Unique || opts.UniqueCount {
+        unique = newMatchSet()
+    }
+    // deduplicated counts the files left out as copies of others
+    var deduplicated atomic.Int64
+
+    // Each file is a job to do.
+    // Add a Job struct to the jobs channel for each file,
+    // and then close the channel. Stop early when the context is done.
+    go func() {
+        defer close(jobs)
+        walked := walk(feed, fsys, fnames, opts, func(err error) {
+            select {
+            case results <- Result{Err: newFileError("", err)}:
+            case <-feed.Done():
+            }
+        })
+        // The walkers may still report errors after the search was
+        // stopped, the results are only closed when they are done
+        defer func() {
+            for range walked {
+            }
+        }()
+        paths := walked
+        var aliases map[string][]string
+        if opts.DedupeLinks != "" {
+            paths, aliases = dedupeLinkPaths(feed, fsys, paths, opts, &deduplicated)
+        }
+        if opts.DedupeContent {
+            paths, aliases = dedupePaths(feed, fsys, paths, aliases, opts, &deduplicated)
+        }
+        if opts.sorting() {
+            paths = sortPaths(feed, fsys, paths, opts)
+        }
+        seq := 0
+        for fname := range paths {
+            prefetch.add(fname)
+            select {
+            case jobs <- Job{fname: fname, fsys: fsys, seq: seq, results: results, memory: memory, unique: unique,
+                aliases: aliases[fname], scanned: scanned, watch: watch, opts: opts}:
+                seq++
+            case <-feed.Done():
+                return
+            }
+        }
+    }()
+
+    // Setup the worker goroutines that process
+    // the jobs channel
+    for i := 0; i < opts.workers(); i++ {
+        go func() {
+            // The label tells the workers apart in a --profile
+            labels := pprof.Labels("worker", strconv.Itoa(i))
+            pprof.Do(ctx, labels, func(ctx context.Context) {
+                for job := range jobs {
+                    if feed.Err() == nil {
+                        job.Do(ctx, pat)
+                    }
+                }
+            })
+            // jobs channel has been closed:
+            // Signal that work has been done
+            done <- struct{}{}
+        }()
+    }
+
+    // Wait for the completion of all worker goroutines, and
+    // then close the results channel
+    go func() {
+        for i := 0; i < opts.workers(); i++ {
+            <-done
+        }
+        close(results)
+    }()
+
+    // Process the results in the main goroutine, reading from
+    // the results channel until it is have been closed
+    // After the sink failed, the rest of the results is drained, so
+    // that the workers can finish
+    var sinkErr error
+    print := func(result Result) {
+        if sinkErr != nil {
+            return
+        }
+        start := opts.Stats.now()
+        if err := sink(result); err != nil {
+            sinkErr = err
+            cancel()
+        }
+        opts.Stats.add(printStage, start)
+    }
+    var summary Summary
+    if opts.sorting() || opts.withContext() {
+        // The results of a file must wait for all files before it,
+        // also to keep the context lines of a file together
+        buffer := newReorder(memory, print)
+        for result := range results {
+            summary.add(result, opts)
+            buffer.add(result)
+        }
+        buffer.close()
+    } else if opts.JSON {
+        // JSON consumers get the results of a file together
+        buffer := newBatcher(memory, print)
+        for result := range results {
+            summary.add(result, opts)
+            buffer.add(result)
+        }
+        buffer.close()
+    } else {
+        for result := range results {
+            summary.add(result, opts)
+            if !result.done {
+                print(result)
+                memory.Release(int64(len(result.Text)))
+            }
+        }
+    }
+
+    // The distinct matches with their counts come last,
+    // then the summary
+    if opts.UniqueCount {
+        unique.each(func(match string, count int) {
+            print(Result{Text: match, Count: count})
+        })
+    }
+    summary.Truncated = scanned.reached()
+    summary.Deduplicated = int(deduplicated.Load())
+    print(Result{Summary: &summary})
+    if sinkErr == nil && summary.Truncated {
+        return ErrScanLimit
+    }
+    return sinkErr
+}
+
+// searchable reports whether a file of the given mode should be handed
+// to a worker. Devices, FIFOs and sockets are skipped unless -D read is
+// given, because reading them may block a worker forever.
+func (opts *Options) searchable(mode os.FileMode) bool {
+    return opts.Devices == "read" || mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) == 0
+}
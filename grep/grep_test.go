@@ -0,0 +1,68 @@
+package grep
+
+import (
+    "context"
+    "flag"
+    "io/fs"
+    "slices"
+    "testing"
+)
+
+// setOptions parses args like the command line of cgrep, from the
+// default options, and returns the pattern of the first argument
+// compiled with them
+func setOptions(t *testing.T, args ...string) *Pattern {
+    t.Helper()
+    fs := flag.NewFlagSet("cgrep", flag.ContinueOnError)
+    var opts Options
+    opts.Flags(fs)
+    if err := fs.Parse(args); err != nil {
+        t.Fatal(err)
+    }
+    pat, err := Compile(opts, fs.Arg(0))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pat
+}
+
+// searchResults searches roots in fsys and returns the results the sink
+// got, without the summary, and the error of the search
+func searchResults(t *testing.T, fsys fs.FS, pat *Pattern, roots ...string) ([]Result, error) {
+    t.Helper()
+    var results []Result
+    err := SearchFS(context.Background(), fsys, pat, roots, func(result Result) error {
+        if result.Summary == nil {
+            results = append(results, result)
+        }
+        return nil
+    })
+    return results, err
+}
+
+// matchedLines returns fname:line for each matching line of results,
+// fname: and the message for each error, and fname: binary for a
+// matching binary file
+func matchedLines(results []Result) []string {
+    var lines []string
+    for _, result := range results {
+        switch {
+        case result.Err != nil:
+            lines = append(lines, result.Err.File+": "+result.Err.Message)
+        case result.Binary:
+            lines = append(lines, result.File+": binary")
+        case !result.Context:
+            lines = append(lines, result.File+":"+result.Text)
+        }
+    }
+    return lines
+}
+
+// equalLines reports whether the lines are the same in any order, as
+// the files are searched concurrently
+func equalLines(got, want []string) bool {
+    got, want = slices.Clone(got), slices.Clone(want)
+    slices.Sort(got)
+    slices.Sort(want)
+    return slices.Equal(got, want)
+}
@@ -0,0 +1,163 @@
+package grep
+
+import (
+    "io/fs"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// The files holding ignore rules, read in every directory
+var ignoreFiles = []string{".gitignore", ".ignore"}
+
+// An ignoreRule is a single pattern of an ignore file, in .gitignore
+// syntax
+type ignoreRule struct {
+    rx       *regexp.Regexp
+    negate   bool // a leading "!" brings a path back in
+    dirOnly  bool // a trailing "/" only matches directories
+    anchored bool // matches the path below the directory, not just the name
+}
+
+// An ignoreLayer holds the rules of the ignore files in one directory.
+// The layers of the parent directories come first, the rules of deeper
+// layers and later rules win.
+type ignoreLayer struct {
+    parent *ignoreLayer
+    dir    string
+    rules  []ignoreRule
+}
+
+// load returns the layer for dir: a new one on top of l, if dir has
+// ignore files among its entries, otherwise l itself. dir is one of fsys.
+func (l *ignoreLayer) load(fsys fs.FS, dir string, entries []os.DirEntry) *ignoreLayer {
+    var rules []ignoreRule
+    for _, entry := range entries {
+        for _, name := range ignoreFiles {
+            if entry.Name() != name || entry.IsDir() {
+                continue
+            }
+            if text, err := readFile(fsys, joinPath(fsys, dir, name)); err == nil {
+                rules = append(rules, parseIgnore(string(text))...)
+            }
+        }
+    }
+    if rules == nil {
+        return l
+    }
+    return &ignoreLayer{parent: l, dir: dir, rules: rules}
+}
+
+// ignored reports whether path is ignored by the rules of l and its parents
+func (l *ignoreLayer) ignored(path string, isDir bool) bool {
+    var layers []*ignoreLayer
+    for ; l != nil; l = l.parent {
+        layers = append(layers, l)
+    }
+
+    ignored := false
+    for i := len(layers) - 1; i >= 0; i-- {
+        rel, err := filepath.Rel(layers[i].dir, path)
+        if err != nil {
+            continue
+        }
+        rel = filepath.ToSlash(rel)
+        name := filepath.Base(path)
+        for _, rule := range layers[i].rules {
+            if rule.dirOnly && !isDir {
+                continue
+            }
+            target := name
+            if rule.anchored {
+                target = rel
+            }
+            if rule.rx.MatchString(target) {
+                ignored = !rule.negate
+            }
+        }
+    }
+    return ignored
+}
+
+// parseIgnore parses the rules of an ignore file, skipping blank lines,
+// comments and patterns we can't translate
+func parseIgnore(text string) []ignoreRule {
+    var rules []ignoreRule
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimRight(line, "\r")
+        if !strings.HasSuffix(line, `\ `) {
+            line = strings.TrimRight(line, " ")
+        }
+        if line == "" || line[0] == '#' {
+            continue
+        }
+
+        var rule ignoreRule
+        if line[0] == '!' {
+            rule.negate, line = true, line[1:]
+        } else if line[0] == '\\' {
+            line = line[1:]
+        }
+        if strings.HasSuffix(line, "/") {
+            rule.dirOnly, line = true, strings.TrimSuffix(line, "/")
+        }
+        // A slash at the start or in the middle anchors the pattern
+        if strings.Contains(line, "/") {
+            rule.anchored, line = true, strings.TrimPrefix(line, "/")
+        }
+        if line == "" {
+            continue
+        }
+
+        rx, err := regexp.Compile("^" + globToRegexp(line) + "$")
+        if err != nil {
+            continue
+        }
+        rule.rx = rx
+        rules = append(rules, rule)
+    }
+    return rules
+}
+
+// globToRegexp translates an ignore pattern to a regular expression:
+// "*" and "?" don't match a slash, "**" matches any number of
+// directories, character classes are kept as they are
+func globToRegexp(glob string) string {
+    var b strings.Builder
+    for i := 0; i < len(glob); i++ {
+        switch c := glob[i]; {
+        case strings.HasPrefix(glob[i:], "**/"):
+            b.WriteString("(?:.*/)?")
+            i += 2
+        case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+            b.WriteString("/.*")
+            i += 2
+        case strings.HasPrefix(glob[i:], "**"):
+            b.WriteString(".*")
+            i++
+        case c == '*':
+            b.WriteString("[^/]*")
+        case c == '?':
+            b.WriteString("[^/]")
+        case c == '[':
+            end := strings.IndexByte(glob[i+1:], ']')
+            if end < 0 {
+                b.WriteString(`\[`)
+                continue
+            }
+            class := glob[i+1 : i+1+end]
+            if strings.HasPrefix(class, "!") {
+                class = "^" + class[1:]
+            }
+            b.WriteString("[" + class + "]")
+            i += end + 1
+        case c == '\\' && i+1 < len(glob):
+            i++
+            b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+        default:
+            b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+        }
+    }
+    return b.String()
+}
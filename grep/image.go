@@ -0,0 +1,264 @@
+package grep
+
+import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "strings"
+)
+
+// Metadata entries of an image tarball larger than this are no manifests
+const maxManifestSize = 1 << 20
+
+// SearchImage searches every regular file in the layers of the image
+// tarball, in the order of the tarball. The files of a layer are
+// read one after the other, as a tar stream can't be read in parallel.
+func SearchImage(ctx context.Context, pat *Pattern, tarball string, sink Sink) error {
+    if _, err := os.Stat(OSPath(tarball)); err != nil {
+        if errors.Is(err, fs.ErrNotExist) && !strings.ContainsAny(tarball, `/\`) {
+            // Most likely a reference like alpine:3.19
+            return fmt.Errorf("%s: pulling images isn't supported, search the output of docker save instead", tarball)
+        }
+        return err
+    }
+    layers, err := imageLayers(tarball)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    memory := newBudget(int64(pat.opts.MaxMemory))
+    var unique *matchSet
+    if pat.opts.Unique || pat.opts.UniqueCount {
+        unique = newMatchSet()
+    }
+
+    found := make(chan Result)
+    go func() {
+        defer close(found)
+        err := eachTarEntry(tarball, func(name string, r io.Reader) error {
+            digest, ok := layers[name]
+            if !ok {
+                return nil
+            }
+            err := searchLayer(ctx, digest, r, pat, memory, unique, found)
+            if err != nil && ctx.Err() == nil {
+                found <- Result{Err: newFileError(digest, err)}
+            }
+            return ctx.Err()
+        })
+        if err != nil && ctx.Err() == nil {
+            found <- Result{Err: newFileError(tarball, err)}
+        }
+    }()
+
+    // Like the collector of SearchFS, the results are drained after
+    // the sink failed
+    var sinkErr error
+    print := func(result Result) {
+        if sinkErr == nil {
+            if sinkErr = sink(result); sinkErr != nil {
+                cancel()
+            }
+        }
+    }
+    var summary Summary
+    for result := range found {
+        summary.add(result, pat.opts)
+        if !result.done {
+            print(result)
+            memory.Release(int64(len(result.Text)))
+        }
+    }
+    if pat.opts.UniqueCount {
+        unique.each(func(match string, count int) {
+            print(Result{Text: match, Count: count})
+        })
+    }
+    print(Result{Summary: &summary})
+    return sinkErr
+}
+
+// searchLayer searches the regular files of the layer tar stream r,
+// which may be gzip compressed. Whiteouts, the markers of files deleted
+// by the layer, are skipped.
+func searchLayer(ctx context.Context, digest string, r io.Reader, pat *Pattern,
+    memory *budget, unique *matchSet, found chan<- Result) error {
+    buffered := bufio.NewReader(r)
+    var layer io.Reader = buffered
+    if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+        zr, err := gzip.NewReader(buffered)
+        if err != nil {
+            return err
+        }
+        defer zr.Close()
+        layer = zr
+    }
+
+    files := tar.NewReader(layer)
+    for ctx.Err() == nil {
+        hdr, err := files.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(hdr.Name), ".wh.") {
+            continue
+        }
+
+        job := Job{fname: digest + ":" + path.Clean("/" + hdr.Name), opts: pat.opts, memory: memory, unique: unique}
+        pat.opts.Stats.file()
+        count, err := job.scanBuffered(ctx, files, pat, found, job.scanLines)
+        if err != nil {
+            // A broken file breaks the rest of the layer as well
+            return err
+        }
+        job.sendCount(ctx, found, count)
+        select {
+        case found <- Result{File: job.fname, done: true}:
+        case <-ctx.Done():
+        }
+    }
+    return nil
+}
+
+// The manifest.json written by docker save
+type dockerManifest []struct {
+    Layers []string
+}
+
+// The index.json of an OCI image layout, and the manifests and indexes
+// in its blobs
+type ociManifest struct {
+    Manifests []ociDescriptor `json:"manifests"`
+    Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+    Digest string `json:"digest"`
+}
+
+// imageLayers reads the manifests of the image tarball and returns the
+// names of the tar entries of the layers, mapped to their digests
+func imageLayers(tarball string) (map[string]string, error) {
+    // The layers of the manifests are in the tarball too, so it is
+    // read twice: here for the small metadata, later for the layers
+    metadata := make(map[string][]byte)
+    err := eachTarEntry(tarball, func(name string, r io.Reader) error {
+        if !strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, "blobs/") {
+            return nil
+        }
+        data, err := io.ReadAll(io.LimitReader(r, maxManifestSize+1))
+        if err != nil {
+            return err
+        }
+        if len(data) <= maxManifestSize && json.Valid(data) {
+            metadata[name] = data
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    layers := make(map[string]string)
+    if data, ok := metadata["manifest.json"]; ok {
+        var manifest dockerManifest
+        if err := json.Unmarshal(data, &manifest); err != nil {
+            return nil, fmt.Errorf("%s: manifest.json: %s", tarball, err)
+        }
+        for _, image := range manifest {
+            for _, name := range image.Layers {
+                layers[name] = layerDigest(name)
+            }
+        }
+    } else if data, ok := metadata["index.json"]; ok {
+        if err := ociLayers(metadata, data, layers, 0); err != nil {
+            return nil, fmt.Errorf("%s: index.json: %s", tarball, err)
+        }
+    } else {
+        return nil, fmt.Errorf("%s: no manifest.json or index.json, not an image tarball", tarball)
+    }
+    return layers, nil
+}
+
+// ociLayers adds the layers of the OCI manifest or index in data.
+// Indexes, e.g. of multi-platform images, are followed down to
+// their manifests.
+func ociLayers(metadata map[string][]byte, data []byte, layers map[string]string, depth int) error {
+    if depth > 8 {
+        return errors.New("indexes nested too deeply")
+    }
+    var manifest ociManifest
+    if err := json.Unmarshal(data, &manifest); err != nil {
+        return err
+    }
+    for _, layer := range manifest.Layers {
+        layers[blobName(layer.Digest)] = layer.Digest
+    }
+    for _, child := range manifest.Manifests {
+        data, ok := metadata[blobName(child.Digest)]
+        if !ok {
+            return fmt.Errorf("missing manifest %s", child.Digest)
+        }
+        if err := ociLayers(metadata, data, layers, depth+1); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// blobName returns the tar entry of the blob with digest,
+// e.g. blobs/sha256/e3b0... for sha256:e3b0...
+func blobName(digest string) string {
+    return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// layerDigest returns the digest of the layer in the tar entry name.
+// Older versions of docker save name the layers by their ID instead,
+// e.g. 5f70.../layer.tar, then the ID is used.
+func layerDigest(name string) string {
+    if rest, ok := strings.CutPrefix(name, "blobs/"); ok {
+        return strings.Replace(rest, "/", ":", 1)
+    }
+    return strings.TrimSuffix(name, "/layer.tar")
+}
+
+// eachTarEntry calls f for every regular file in the tarball,
+// with its cleaned name and contents, until f fails
+func eachTarEntry(tarball string, f func(name string, r io.Reader) error) error {
+    file, err := os.Open(OSPath(tarball))
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    entries := tar.NewReader(bufio.NewReader(file))
+    for {
+        hdr, err := entries.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return &fs.PathError{Op: "read", Path: tarball, Err: err}
+        }
+        if hdr.Typeflag != tar.TypeReg {
+            continue
+        }
+        if err := f(path.Clean(strings.TrimPrefix(hdr.Name, "./")), entries); err != nil {
+            return err
+        }
+    }
+}
@@ -0,0 +1,81 @@
+package grep
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// ioLimit is a token bucket for --io-limit, shared by all workers: a
+// read takes a token per byte, and the tokens come back at the rate,
+// up to a second's worth. A nil *ioLimit has no limit.
+type ioLimit struct {
+    rate   float64 // bytes per second
+    mu     sync.Mutex
+    tokens float64
+    last   time.Time
+}
+
+// newIOLimit returns a limit of rate bytes per second, or nil for rate = 0
+func newIOLimit(rate int64) *ioLimit {
+    if rate <= 0 {
+        return nil
+    }
+    return &ioLimit{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// burst is the most bytes read at once
+func (l *ioLimit) burst() int {
+    return max(1, int(l.rate))
+}
+
+// wait takes n tokens and waits until the bucket is no longer in debt.
+// It returns false, if the context is done first.
+func (l *ioLimit) wait(ctx context.Context, n int) bool {
+    l.mu.Lock()
+    now := time.Now()
+    l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+    l.last = now
+    l.tokens -= float64(n)
+    debt := l.tokens
+    l.mu.Unlock()
+    if debt >= 0 {
+        return true
+    }
+
+    timer := time.NewTimer(time.Duration(-debt / l.rate * float64(time.Second)))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// reader returns r limited to the rate, or r itself without a limit
+func (l *ioLimit) reader(ctx context.Context, r io.Reader) io.Reader {
+    if l == nil {
+        return r
+    }
+    return &rateReader{ctx: ctx, r: r, limit: l}
+}
+
+// rateReader reads at most a burst at a time and pays for it afterwards
+type rateReader struct {
+    ctx   context.Context
+    r     io.Reader
+    limit *ioLimit
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+    if len(p) > r.limit.burst() {
+        p = p[:r.limit.burst()]
+    }
+    n, err := r.r.Read(p)
+    if !r.limit.wait(r.ctx, n) && err == nil {
+        err = r.ctx.Err()
+    }
+    return n, err
+}
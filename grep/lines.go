@@ -0,0 +1,70 @@
+package grep
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// LineRange is the flag value of --line-range: the lines First to Last
+// of every file, counting from 1. A Last of 0 means the end of the file.
+type LineRange struct {
+    First int
+    Last  int
+}
+
+// String returns the range in the syntax of Set
+func (r *LineRange) String() string {
+    if r.First == 0 {
+        return ""
+    }
+    if r.Last == 0 {
+        return strconv.Itoa(r.First) + ":"
+    }
+    return strconv.Itoa(r.First) + ":" + strconv.Itoa(r.Last)
+}
+
+// Set parses first:last, where either may be left out, and first:+n
+// for the n lines from first on
+func (r *LineRange) Set(value string) error {
+    from, to, ok := strings.Cut(value, ":")
+    if !ok {
+        return fmt.Errorf("invalid line range %q, want first:last", value)
+    }
+    first, last := 1, 0
+    var err error
+    if from != "" {
+        if first, err = strconv.Atoi(from); err != nil || first < 1 {
+            return fmt.Errorf("invalid first line %q", from)
+        }
+    }
+    if n, relative := strings.CutPrefix(to, "+"); relative {
+        count, err := strconv.Atoi(n)
+        if err != nil || count < 1 {
+            return fmt.Errorf("invalid number of lines %q", n)
+        }
+        last = first + count - 1
+    } else if to != "" {
+        if last, err = strconv.Atoi(to); err != nil || last < first {
+            return fmt.Errorf("invalid last line %q", to)
+        }
+    }
+    r.First, r.Last = first, last
+    return nil
+}
+
+// all reports whether whole files are searched
+func (r *LineRange) all() bool {
+    return r.First <= 1 && r.Last == 0
+}
+
+// contains reports whether line lino is searched
+func (r *LineRange) contains(lino int) bool {
+    return lino >= r.First && (r.Last == 0 || lino <= r.Last)
+}
+
+// past reports whether line lino comes after the range, so that
+// reading can stop
+func (r *LineRange) past(lino int) bool {
+    return r.Last > 0 && lino > r.Last
+}
@@ -0,0 +1,60 @@
+package grep
+
+import (
+    "bytes"
+    "io"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+)
+
+// The number of bytes http.DetectContentType looks at
+const sniffSize = 512
+
+// parseMime splits the --mime spec into its patterns and checks them
+func parseMime(spec string) ([]string, error) {
+    var patterns []string
+    for _, pattern := range strings.Split(spec, ",") {
+        pattern = strings.TrimSpace(pattern)
+        if _, err := path.Match(pattern, ""); err != nil {
+            return nil, err
+        }
+        patterns = append(patterns, pattern)
+    }
+    return patterns, nil
+}
+
+// sniffType guesses the MIME type of the file from its first bytes,
+// without moving its offset. Text that starts like a JSON object or
+// array is taken for application/json, which http.DetectContentType
+// doesn't know about.
+func sniffType(file *os.File) (string, error) {
+    buf := make([]byte, sniffSize)
+    n, err := file.ReadAt(buf, 0)
+    if err != nil && err != io.EOF {
+        return "", err
+    }
+    return detectType(buf[:n]), nil
+}
+
+// detectType guesses the MIME type of the first bytes of a file
+func detectType(head []byte) string {
+    mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+    if trimmed := bytes.TrimLeft(head, " \t\r\n"); mimeType == "text/plain" && len(trimmed) > 0 &&
+        (trimmed[0] == '{' || trimmed[0] == '[') {
+        return "application/json"
+    }
+    return mimeType
+}
+
+// mimeAllowed reports whether a file of mimeType is searched
+func (opts *Options) mimeAllowed(mimeType string) bool {
+    for _, pattern := range opts.mime {
+        if ok, _ := path.Match(pattern, mimeType); ok {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,88 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "os"
+)
+
+// scanMapped maps the whole file into memory and searches it in one go.
+// Instead of matching line by line it jumps to the candidate lines,
+// using bytes.Index for literal patterns, the foldFinder for -i -F,
+// and the multi-line regexp
+// otherwise, and counts the newlines in between only for line numbers.
+func (job Job) scanMapped(ctx context.Context, file *os.File, size int64,
+    pat *Pattern, found chan<- Result) (int, error) {
+    // The mapping counts against the memory budget
+    job.memory.Hold(size)
+    defer job.memory.Drop(size)
+
+    start := job.opts.Stats.now()
+    data, err := mapFile(file, size)
+    job.opts.Stats.add(readStage, start)
+    if err != nil {
+        return 0, err
+    }
+    defer unmapFile(data)
+    job.opts.Stats.read(len(data))
+    // Only the whole lines --max-bytes-scanned leaves are searched
+    if allowed := job.scanned.take(len(data)); allowed < len(data) {
+        data = wholeLines(data[:allowed])
+    }
+
+    // Reading happens on demand, so it's part of matching here
+    start = job.opts.Stats.now()
+    defer job.opts.Stats.add(matchStage, start)
+
+    if (job.opts.CountOnly || job.opts.FilesOnly) && pat.chunkRx != nil {
+        return countChunk(data, pat, pat.opts.firstMatchOnly()), nil
+    }
+
+    count := 0
+    lino, counted := job.opts.LineStart, 0
+    for pos := 0; pos < len(data) && ctx.Err() == nil; {
+        // Find the start of the next candidate match
+        start := pos
+        switch {
+        case pat.literal != nil:
+            i := bytes.Index(data[pos:], pat.literal)
+            if i < 0 {
+                return count, nil
+            }
+            start = pos + i
+        case pat.findFold():
+            i := pat.fold.index(data[pos:])
+            if i < 0 {
+                return count, nil
+            }
+            start = pos + i
+        case pat.chunkRx != nil:
+            loc := pat.chunkRx.FindIndex(data[pos:])
+            if loc == nil {
+                return count, nil
+            }
+            start = pos + loc[0]
+            if start == len(data) && data[start-1] == '\n' {
+                return count, nil
+            }
+        }
+
+        lineStart := pos + bytes.LastIndexByte(data[pos:start], '\n') + 1
+        lineEnd := len(data)
+        if i := bytes.IndexByte(data[start:], '\n'); i >= 0 {
+            lineEnd = start + i
+        }
+        lino += bytes.Count(data[counted:lineStart], []byte{'\n'})
+        counted = lineStart
+
+        line := bytes.TrimRight(data[lineStart:lineEnd], "\r")
+        if pat.match(line) {
+            count += pat.weight(line)
+            if !job.matched(ctx, found, pat, lino, line) {
+                return count, nil
+            }
+        }
+        pos = lineEnd + 1
+    }
+    return count, nil
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package grep
+
+import (
+    "errors"
+    "os"
+)
+
+// There is no mmap here, the planner never picks it
+const mmapSupported = false
+
+// mapFile isn't supported on this platform
+func mapFile(file *os.File, size int64) ([]byte, error) {
+    return nil, errors.New("mmap is not supported")
+}
+
+// unmapFile isn't supported on this platform
+func unmapFile(data []byte) {
+}
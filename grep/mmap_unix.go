@@ -0,0 +1,26 @@
+//go:build unix
+
+package grep
+
+import (
+    "os"
+    "syscall"
+)
+
+// The file can be mapped into memory
+const mmapSupported = true
+
+// mapFile maps size bytes of file read-only into memory
+func mapFile(file *os.File, size int64) ([]byte, error) {
+    data, err := syscall.Mmap(int(file.Fd()), 0, int(size),
+        syscall.PROT_READ, syscall.MAP_SHARED)
+    if err != nil {
+        return nil, &os.PathError{Op: "mmap", Path: file.Name(), Err: err}
+    }
+    return data, nil
+}
+
+// unmapFile releases a mapping made by mapFile
+func unmapFile(data []byte) {
+    syscall.Munmap(data)
+}
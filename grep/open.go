@@ -0,0 +1,99 @@
+package grep
+
+import (
+    "context"
+    "io/fs"
+    "os"
+    "sync"
+    "time"
+)
+
+// openSlots is a semaphore limiting the files and directories open at
+// the same time, sized from the limit of the process on first use
+var (
+    openSlots     chan struct{}
+    openSlotsOnce sync.Once
+)
+
+// How often and how patiently a transient open failure is retried
+const (
+    openRetries    = 8
+    openBackoff    = 10 * time.Millisecond
+    openMaxBackoff = time.Second
+)
+
+// acquireOpen waits for a free slot to open a file.
+// It returns false, if the context is done first.
+func acquireOpen(ctx context.Context) bool {
+    openSlotsOnce.Do(func() {
+        openSlots = make(chan struct{}, maxOpenFiles())
+    })
+    select {
+    case openSlots <- struct{}{}:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// releaseOpen frees a slot taken by acquireOpen
+func releaseOpen() {
+    <-openSlots
+}
+
+// retryOpen calls open until it succeeds, fails for good, or has
+// failed transiently too often, backing off between the attempts.
+// Running out of file descriptors is transient: other workers close
+// theirs soon.
+func retryOpen(ctx context.Context, open func() error) error {
+    backoff := openBackoff
+    for attempt := 1; ; attempt++ {
+        err := open()
+        if err == nil || !transientOpenError(err) || attempt == openRetries {
+            return err
+        }
+        select {
+        case <-time.After(backoff):
+        case <-ctx.Done():
+            return err
+        }
+        backoff = min(2*backoff, openMaxBackoff)
+    }
+}
+
+// openFile opens name for reading in a free slot, retrying transient
+// failures. The returned function frees the slot again, after the file
+// has been closed.
+func openFile(ctx context.Context, name string) (*os.File, func(), error) {
+    if !acquireOpen(ctx) {
+        return nil, nil, ctx.Err()
+    }
+    var file *os.File
+    err := retryOpen(ctx, func() (err error) {
+        file, err = os.Open(OSPath(name))
+        return err
+    })
+    if err != nil {
+        releaseOpen()
+        return nil, nil, userPath(err, name)
+    }
+    return file, releaseOpen, nil
+}
+
+// readDir reads a directory in a free slot, retrying transient failures
+// on disk
+func readDir(ctx context.Context, fsys fs.FS, name string) ([]os.DirEntry, error) {
+    if !acquireOpen(ctx) {
+        return nil, ctx.Err()
+    }
+    defer releaseOpen()
+    if fsys != nil {
+        return fs.ReadDir(fsys, name)
+    }
+    var entries []os.DirEntry
+    err := retryOpen(ctx, func() (err error) {
+        entries, err = os.ReadDir(OSPath(name))
+        return err
+    })
+    return entries, userPath(err, name)
+}
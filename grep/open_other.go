@@ -0,0 +1,20 @@
+//go:build !unix
+
+package grep
+
+import (
+    "errors"
+    "syscall"
+)
+
+// maxOpenFiles is the number of files we may have open at once,
+// there is no limit to ask for here
+func maxOpenFiles() int {
+    return 512
+}
+
+// transientOpenError reports whether err is worth retrying:
+// the process or the system ran out of file descriptors
+func transientOpenError(err error) bool {
+    return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
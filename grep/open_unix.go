@@ -0,0 +1,31 @@
+//go:build unix
+
+package grep
+
+import (
+    "errors"
+    "syscall"
+)
+
+// maxOpenFiles is the number of files we may have open at once:
+// the soft limit of the process, less a reserve for stdio, sockets
+// and the runtime
+func maxOpenFiles() int {
+    const reserve, upper = 32, 4096
+    var limit syscall.Rlimit
+    if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+        return 256
+    }
+    n := int64(limit.Cur) - reserve
+    if limit.Cur > upper {
+        n = upper
+    }
+    return int(max(n, 1))
+}
+
+// transientOpenError reports whether err is worth retrying:
+// the process or the system ran out of file descriptors
+func transientOpenError(err error) bool {
+    return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+        errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,293 @@
+package grep
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "runtime"
+    "time"
+)
+
+// Options are the options of a search, those of the command line of
+// cgrep that aren't about the command itself. Compile checks them and
+// keeps a copy of them with the pattern, so the caller may change them
+// for the next search. The zero Options aren't valid, start from
+// DefaultOptions.
+type Options struct {
+    // The pattern syntax, at most one of them, RE2 by default
+    BasicRegexp    bool // -G
+    ExtendedRegexp bool // -E
+    PerlRegexp     bool // -P
+    Glob           bool // --glob-pattern
+    FixedStrings   bool // -F
+
+    IgnoreCase  bool   // -i
+    Fold        bool   // --fold
+    FoldAccents bool   // --fold-accents
+    Preset      string // --preset, the rule packs to search for instead of a regexp
+
+    // The files searched
+    Recursive     bool      // -r
+    Follow        bool      // -R
+    NoIgnore      bool      // --no-ignore
+    MaxDepth      int       // --max-depth
+    Devices       string    // -D, read or skip
+    MIME          string    // --mime
+    Lines         LineRange // --line-range
+    Delimiter     string    // --delimiter, with the escapes of the command line
+    Pre           string    // --pre
+    PreCacheDir   string    // --pre-cache-dir
+    PreCacheSize  ByteSize  // --pre-cache-size
+    DedupeLinks   string    // --dedupe-links, all or first, "" for none
+    DedupeContent bool      // --dedupe-content
+    Sort          string    // --sort
+    SortReverse   string    // --sortr
+    BinaryOffsets bool      // --binary-offsets
+
+    // The results
+    CountOnly    bool // -c
+    CountMatches bool // --count-matches
+    IncludeZero  bool // --include-zero
+    Total        bool // --total
+    FilesOnly    bool // -l
+    MinMatches   int  // --files-with-at-least
+    MaxMatches   int  // --files-with-at-most
+    OnlyMatching bool // -o
+    Unique       bool // --unique
+    UniqueCount  bool // --unique-count
+    Before       int  // -B
+    After        int  // -A
+    Context      int  // -C, for -A and -B left at 0
+    Passthru     bool // --passthru
+    SummaryByDir bool // --summary-by-dir, for the sink of NewDirSummary
+    SummaryDepth int  // --summary-depth
+
+    // How the results are printed by the sinks
+    JSON             bool   // --json
+    Format           string // --format
+    Window           int    // --window
+    Filenames        bool   // print the file names, -H, -h or more than one file on the command line
+    LineNumbers      bool   // print the line numbers, -n, --no-line-number or a terminal or JSON
+    LineStart        int    // --line-number-start
+    FieldSeparator   string // --field-separator
+    ContextSeparator string // --context-separator
+    Color            bool   // color the output, --color or a terminal
+    Colors           string // --colors
+    PatternColors    string // --pattern-colors
+    NoMessages       bool   // -s
+
+    // How the files are searched
+    Strategy        string        // --strategy
+    Workers         int           // the files searched at the same time, 0 for one per CPU
+    Prefetch        int           // --prefetch
+    MaxMemory       ByteSize      // --max-memory
+    MaxURLSize      ByteSize      // --max-url-size
+    MaxBytesScanned ByteSize      // --max-bytes-scanned
+    IOLimit         ByteSize      // --io-limit
+    FileTimeout     time.Duration // --file-timeout
+    Watchdog        time.Duration // --watchdog
+    WatchdogAbandon bool          // --watchdog-abandon
+    Stats           *Stats        // collects the files and bytes read and the time spent, if set
+
+    // What Compile sets up from the options
+    delimiter []byte       // separates the records
+    theme     *colorTheme  // nil, if the output isn't colored
+    format    []formatPart // the parsed --format template, nil without one
+    mime      []string     // the patterns of --mime
+    diskRate  *ioLimit     // the --io-limit, shared by the workers
+}
+
+// DefaultOptions returns the options of cgrep without any on the command line
+func DefaultOptions() Options {
+    var opts Options
+    opts.Flags(flag.NewFlagSet("", flag.ContinueOnError))
+    return opts
+}
+
+// Flags defines the command line flags of the options in fs, with the
+// defaults of cgrep
+func (opts *Options) Flags(fs *flag.FlagSet) {
+    opts.PreCacheSize = 1 << 30
+    fs.DurationVar(&opts.FileTimeout, "file-timeout", 0, "give up on a single file after this long (0 means no limit)")
+    fs.StringVar(&opts.Devices, "D", "skip", "what to do with devices, FIFOs and sockets: `action` is read or skip")
+    fs.BoolVar(&opts.CountOnly, "c", false, "print only a count of matching lines per file")
+    fs.BoolVar(&opts.FilesOnly, "l", false, "print only the names of files with matches")
+    fs.StringVar(&opts.Strategy, "strategy", "auto", "force the search `strategy`: auto, bufio, mmap or chunked")
+    fs.StringVar(&opts.PatternColors, "pattern-colors", "", "color the matches of several -e patterns with the SGR `colors`, comma separated, e.g. 01;31,01;32, used round-robin")
+    fs.StringVar(&opts.Colors, "colors", "", "the colors as `capabilities` in GREP_COLORS syntax, e.g. ms=01;32:fn=34")
+    fs.IntVar(&opts.Window, "window", 0, "show lines longer than `width` characters as a window around the first match (0 shows whole lines)")
+    fs.BoolVar(&opts.JSON, "json", false, "print the results as JSON lines")
+    fs.StringVar(&opts.Format, "format", "", "print the results with a `template` like '{file}:{line}:{groups.user}'")
+    fs.StringVar(&opts.Delimiter, "delimiter", "", "separate records by `string` instead of lines, it may contain \\n, \\r, \\t, \\0 and \\\\")
+    fs.StringVar(&opts.Sort, "sort", "none", "sort the results by `key`: none, path, modified or size")
+    fs.StringVar(&opts.SortReverse, "sortr", "none", "sort the results in reverse by `key`: none, path, modified or size")
+    fs.BoolVar(&opts.Recursive, "r", false, "search the directories recursively")
+    fs.BoolVar(&opts.Follow, "R", false, "search the directories recursively, following symbolic links")
+    fs.BoolVar(&opts.NoIgnore, "no-ignore", false, "don't respect .gitignore and .ignore files with -r and -R")
+    fs.BoolVar(&opts.BasicRegexp, "G", false, "the regexp is a POSIX basic regular expression, like grep")
+    fs.BoolVar(&opts.ExtendedRegexp, "E", false, "the regexp is a POSIX extended regular expression, like egrep")
+    fs.BoolVar(&opts.PerlRegexp, "P", false, "the regexp is an RE2 regular expression, the default")
+    fs.BoolVar(&opts.Glob, "glob-pattern", false, "the regexp is a wildcard pattern with *, ? and [...]")
+    fs.BoolVar(&opts.FixedStrings, "F", false, "the regexp is a fixed string, not a regular expression")
+    fs.BoolVar(&opts.IgnoreCase, "i", false, "ignore case distinctions")
+    fs.BoolVar(&opts.SummaryByDir, "summary-by-dir", false, "print the match counts rolled up by directory instead of the matches")
+    fs.IntVar(&opts.SummaryDepth, "summary-depth", 0, "show the directories of the summary down to `depth` (0 shows all)")
+    fs.BoolVar(&opts.OnlyMatching, "o", false, "print only the matching parts of the lines, each on a line of its own")
+    fs.BoolVar(&opts.Unique, "unique", false, "with -o, print each distinct match once")
+    fs.BoolVar(&opts.UniqueCount, "unique-count", false, "with -o, print each distinct match once with the number of its occurrences")
+    fs.StringVar(&opts.Preset, "preset", "", "search for the rules of the built-in pattern `packs` instead of a regexp: secrets, ipv4, email or url, comma separated")
+    fs.IntVar(&opts.After, "A", 0, "print `num` lines of context after each match")
+    fs.IntVar(&opts.Before, "B", 0, "print `num` lines of context before each match")
+    fs.IntVar(&opts.Context, "C", 0, "print `num` lines of context before and after each match")
+    fs.IntVar(&opts.LineStart, "line-number-start", 1, "number the first line of each file `n`, for fragments of a larger file")
+    fs.BoolVar(&opts.NoMessages, "s", false, "don't print error messages about files and directories that can't be read")
+    fs.StringVar(&opts.FieldSeparator, "field-separator", ":", "separate the file name, line number and line by `string`")
+    fs.StringVar(&opts.ContextSeparator, "context-separator", "--", "print `string` between the groups of matches and context lines")
+    fs.BoolVar(&opts.Passthru, "passthru", false, "print every line, not only the matches, which are highlighted")
+    fs.IntVar(&opts.MaxDepth, "max-depth", 0, "with -r and -R, descend at most `depth` levels below the command line directories (0 means no limit)")
+    fs.StringVar(&opts.MIME, "mime", "", "search only files whose contents look like one of the MIME `types`, e.g. text/*,application/json")
+    fs.IntVar(&opts.Prefetch, "prefetch", 0, "read up to `n` queued files ahead of the workers, for slow disks and network file systems, not with --io-limit")
+    fs.BoolVar(&opts.CountMatches, "count-matches", false, "print only a count of the matches per file, not of the matching lines")
+    fs.BoolVar(&opts.IncludeZero, "include-zero", false, "with -c, print the files without matches too")
+    fs.BoolVar(&opts.Total, "total", false, "with -c, print the total of the counts in a last TOTAL row")
+    fs.StringVar(&opts.DedupeLinks, "dedupe-links", "", "search hard-linked files only once, and print the results for `which` of their paths: all or first")
+    fs.BoolVar(&opts.DedupeContent, "dedupe-content", false, "search files with the same contents only once, and print the results for each of them")
+    fs.StringVar(&opts.Pre, "pre", "", "search the output of `command` run with the path of each file, e.g. to convert PDFs into text")
+    fs.BoolVar(&opts.BinaryOffsets, "binary-offsets", false, "print the byte offsets of the matches in binary files with a hex dump around them, instead of lines")
+    fs.StringVar(&opts.PreCacheDir, "pre-cache-dir", "", "keep the output of --pre in `directory` for the next searches, by the hash of the files")
+    fs.IntVar(&opts.MinMatches, "files-with-at-least", 0, "print only the names of files with at least `num` matching lines, or with -c their counts")
+    fs.IntVar(&opts.MaxMatches, "files-with-at-most", 0, "print only the names of files with at most `num` matching lines, or with -c their counts (0 means no limit)")
+    fs.BoolVar(&opts.Fold, "fold", false, "ignore case with the full Unicode case folding, e.g. SS matches ß")
+    fs.BoolVar(&opts.FoldAccents, "fold-accents", false, "like --fold, and ignore the diacritics of Latin letters too, e.g. cafe matches Café")
+    fs.DurationVar(&opts.Watchdog, "watchdog", 0, "log the files searched for longer than this, with the byte they got to (0 means never)")
+    fs.BoolVar(&opts.WatchdogAbandon, "watchdog-abandon", false, "with --watchdog, give up on the files that took that long to open or read from, e.g. on a stalled network mount")
+    fs.Var(&opts.MaxBytesScanned, "max-bytes-scanned", "stop the search after reading `size` in all, e.g. 5G, and exit with status 3 (0 means no limit)")
+    fs.BoolVar(&opts.CountOnly, "count", false, "the same as -c")
+    fs.Var(&opts.Lines, "line-range", "search only the lines `first:last` of each file, either may be left out, first:+n searches n lines")
+    fs.Var(&opts.MaxURLSize, "max-url-size", "give up on URLs whose response is larger than `size` (0 means no limit)")
+    fs.Var(&opts.PreCacheSize, "pre-cache-size", "evict the least recently used output from --pre-cache-dir beyond `size`")
+    fs.Var(&opts.IOLimit, "io-limit", "read at most `rate` bytes per second from the files, e.g. 20M, to spare the disk for others (0 means no limit)")
+    fs.Var(&opts.MaxMemory, "max-memory", "cap the memory held by buffers and pending results at `size`, e.g. 64M (0 means no limit)")
+}
+
+// setup checks the options and sets up what follows from them
+func (opts *Options) setup() error {
+    if opts.Devices != "read" && opts.Devices != "skip" {
+        return fmt.Errorf("invalid -D action: %s", opts.Devices)
+    }
+
+    if _, ok := strategies[opts.Strategy]; !ok {
+        return fmt.Errorf("invalid strategy: %s", opts.Strategy)
+    }
+
+    for _, key := range []string{opts.Sort, opts.SortReverse} {
+        if !sortKeys[key] {
+            return fmt.Errorf("invalid sort key: %s", key)
+        }
+    }
+    if opts.Sort != "none" && opts.SortReverse != "none" {
+        return errors.New("--sort and --sortr exclude each other")
+    }
+
+    if opts.Unique || opts.UniqueCount {
+        opts.OnlyMatching = true
+    }
+    if opts.CountMatches {
+        opts.CountOnly = true
+    }
+    if opts.folding() && (opts.OnlyMatching || opts.BinaryOffsets) {
+        // The matches are in the folded lines, not in the printed ones
+        return errors.New("--fold and --fold-accents exclude -o and --binary-offsets")
+    }
+
+    if opts.MinMatches < 0 || opts.MaxMatches < 0 {
+        return fmt.Errorf("invalid number of matching lines: %d", min(opts.MinMatches, opts.MaxMatches))
+    }
+    if opts.MaxMatches > 0 && opts.MinMatches > opts.MaxMatches {
+        return errors.New("--files-with-at-least is more than --files-with-at-most")
+    }
+    // The thresholds are about files, the matching lines aren't printed
+    if (opts.MinMatches > 0 || opts.MaxMatches > 0) && !opts.CountOnly {
+        opts.FilesOnly = true
+    }
+
+    // Summaries only need the counts per file
+    if opts.SummaryByDir && !opts.FilesOnly {
+        opts.CountOnly = true
+    }
+
+    if err := checkSyntax(opts); err != nil {
+        return err
+    }
+    if opts.Preset != "" && (opts.BasicRegexp || opts.ExtendedRegexp || opts.Glob || opts.FixedStrings) {
+        return errors.New("--preset excludes -G, -E, -F and --glob-pattern")
+    }
+
+    if opts.Context > 0 {
+        // -A and -B win over -C
+        if opts.After == 0 {
+            opts.After = opts.Context
+        }
+        if opts.Before == 0 {
+            opts.Before = opts.Context
+        }
+    }
+    if opts.After < 0 || opts.Before < 0 {
+        return errors.New("invalid number of context lines")
+    }
+
+    if opts.LineStart < 1 {
+        return fmt.Errorf("invalid first line number: %d", opts.LineStart)
+    }
+
+    if opts.DedupeLinks != "" && opts.DedupeLinks != "all" && opts.DedupeLinks != "first" {
+        return fmt.Errorf("invalid --dedupe-links paths: %s", opts.DedupeLinks)
+    }
+
+    if opts.Prefetch < 0 {
+        return fmt.Errorf("invalid number of files to prefetch: %d", opts.Prefetch)
+    }
+
+    if opts.MIME != "" {
+        var err error
+        if opts.mime, err = parseMime(opts.MIME); err != nil {
+            return fmt.Errorf("invalid MIME type pattern: %s", err)
+        }
+    }
+
+    if opts.PreCacheDir != "" {
+        if opts.Pre == "" {
+            return errors.New("--pre-cache-dir needs --pre")
+        }
+        if err := os.MkdirAll(opts.PreCacheDir, 0o700); err != nil {
+            return err
+        }
+    }
+
+    opts.delimiter = []byte{'\n'}
+    if opts.Delimiter != "" {
+        opts.delimiter = unescape(opts.Delimiter)
+    }
+
+    opts.diskRate = newIOLimit(int64(opts.IOLimit))
+
+    if opts.WatchdogAbandon && opts.Watchdog <= 0 {
+        return errors.New("--watchdog-abandon needs --watchdog")
+    }
+
+    return setupColors(opts)
+}
+
+// Validate returns the first problem of the options, nil if there is none
+func (opts Options) Validate() error {
+    return opts.setup()
+}
+
+// workers returns the number of files searched at the same time
+func (opts *Options) workers() int {
+    if opts.Workers > 0 {
+        return opts.Workers
+    }
+    return runtime.NumCPU()
+}
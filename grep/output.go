@@ -0,0 +1,497 @@
+package grep
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// The marker for the cut off parts of a long line
+const ellipsis = "…"
+
+// window cuts a line longer than width characters down to a window of
+// width characters around the first match, and marks the cuts with an
+// ellipsis. This keeps a match deep inside a minified line readable.
+func window(line string, pat *Pattern, width int) string {
+    if width <= 0 || utf8.RuneCountInString(line) <= width {
+        return line
+    }
+    loc := []int{0, 0}
+    if locs := pat.findAll(line, 1); locs != nil {
+        loc = locs[0]
+    }
+
+    var start, end int
+    if n := utf8.RuneCountInString(line[loc[0]:loc[1]]); n >= width {
+        // The match alone fills the window
+        start, end = loc[0], forward(line, loc[0], width)
+    } else {
+        // Share the rest of the window between the two sides, what
+        // one side can't use goes to the other one
+        before := (width - n) / 2
+        after := width - n - before
+        start = backward(line, loc[0], before)
+        after += before - utf8.RuneCountInString(line[start:loc[0]])
+        end = forward(line, loc[1], after)
+        start = backward(line, start, after-utf8.RuneCountInString(line[loc[1]:end]))
+    }
+
+    cut := line[start:end]
+    if start > 0 {
+        cut = ellipsis + cut
+    }
+    if end < len(line) {
+        cut += ellipsis
+    }
+    return cut
+}
+
+// forward returns the offset n characters after offset i in s,
+// or the end of s
+func forward(s string, i, n int) int {
+    for ; n > 0 && i < len(s); n-- {
+        _, size := utf8.DecodeRuneInString(s[i:])
+        i += size
+    }
+    return i
+}
+
+// backward returns the offset n characters before offset i in s,
+// or the start of s
+func backward(s string, i, n int) int {
+    for ; n > 0 && i > 0; n-- {
+        _, size := utf8.DecodeLastRuneInString(s[:i])
+        i -= size
+    }
+    return i
+}
+
+// printer writes the results in the chosen output format:
+// plain text, JSON lines or a --format template
+type printer struct {
+    out  *errWriter
+    pat  *Pattern
+    opts *Options // the options of pat
+    json *json.Encoder
+
+    // The line printed last, to separate the context groups
+    lastFile string
+    lastLino int
+
+    // The file of the open block of the --json stream, and its matches
+    blockFile    string
+    blockMatches int
+
+    // With context lines the --json match records are held back, until
+    // the lines after them are there. The last context lines are kept
+    // for the next match.
+    pending *Result
+    before  []jsonLine
+    after   []jsonLine
+    recent  []Result
+}
+
+// newPrinter returns a printer of results of pat to out
+func newPrinter(out io.Writer, pat *Pattern) *printer {
+    p := &printer{out: &errWriter{w: out}, pat: pat, opts: pat.opts}
+    if pat.opts.JSON {
+        p.json = json.NewEncoder(p.out)
+        p.json.SetEscapeHTML(false)
+    }
+    return p
+}
+
+// print writes a single result. It returns the first write error.
+func (p *printer) print(result Result) error {
+    switch {
+    case p.json != nil:
+        p.printJSON(result)
+    case result.Err != nil:
+        p.opts.logError(result.Err)
+    case result.Summary != nil && p.opts.CountOnly && p.opts.Total:
+        fmt.Fprintf(p.out, "%s%s%d\n", p.opts.theme.colorFname("TOTAL"), p.opts.theme.colorSep(p.opts.FieldSeparator), result.Summary.Matches)
+        p.opts.logUnreadable(result.Summary)
+    case result.Summary != nil:
+        // Only the JSON stream ends with a summary, the unreadable
+        // directories are told at the end
+        p.opts.logUnreadable(result.Summary)
+    case p.opts.format != nil:
+        fmt.Fprintln(p.out, expandFormat(p.opts.format, result))
+    case p.opts.UniqueCount:
+        fmt.Fprintf(p.out, "%7d %s\n", result.Count, highlight(result.Text, p.pat))
+    case p.opts.Unique:
+        fmt.Fprintln(p.out, highlight(result.Text, p.pat))
+    case p.opts.FilesOnly:
+        fmt.Fprintln(p.out, p.opts.theme.colorFname(result.File))
+    case p.opts.CountOnly:
+        fmt.Fprintf(p.out, "%s%d\n", p.fname(result.File, p.opts.FieldSeparator), result.Count)
+    case result.Binary:
+        p.printBinary(result)
+    default:
+        p.separate(result)
+        sep, text := p.opts.FieldSeparator, result.Text
+        if result.Context {
+            // Context lines are told apart by their separator, like in grep
+            sep = "-"
+        } else {
+            text = highlight(window(text, p.pat, p.opts.Window), p.pat)
+        }
+        if result.Rule != "" {
+            // Tag the line with the --preset rule or -e pattern
+            text = "[" + result.Rule + "]" + p.opts.theme.colorSep(sep) + text
+        }
+        lino := ""
+        if p.opts.LineNumbers {
+            lino = p.opts.theme.colorLino(result.Line) + p.opts.theme.colorSep(sep)
+        }
+        fmt.Fprintf(p.out, "%s%s%s\n", p.fname(result.File, sep), lino, text)
+    }
+    return p.out.err
+}
+
+// fname returns the file name with the separator, or nothing, if the
+// file names aren't shown
+func (p *printer) fname(fname, sep string) string {
+    if !p.opts.Filenames {
+        return ""
+    }
+    return p.opts.theme.colorFname(fname) + p.opts.theme.colorSep(sep)
+}
+
+// separate prints the --context-separator before a line, that doesn't
+// follow the line printed last
+func (p *printer) separate(result Result) {
+    if !p.opts.withContext() {
+        return
+    }
+    if p.lastFile != "" && (result.File != p.lastFile || result.Line != p.lastLino+1) {
+        fmt.Fprintln(p.out, p.opts.theme.colorSep(p.opts.ContextSeparator))
+    }
+    p.lastFile, p.lastLino = result.File, result.Line
+}
+
+// errWriter remembers the first write error, and writes nothing after it
+type errWriter struct {
+    w   io.Writer
+    err error
+}
+
+func (ew *errWriter) Write(b []byte) (int, error) {
+    if ew.err != nil {
+        return 0, ew.err
+    }
+    n, err := ew.w.Write(b)
+    ew.err = err
+    return n, err
+}
+
+// The JSON records, one per line. The type field tells them apart.
+type (
+    jsonMatch struct {
+        Type    string      `json:"type"`
+        File    string      `json:"file"`
+        Line    int         `json:"line,omitempty"`
+        Column  int         `json:"column,omitempty"`
+        Text    string      `json:"text"`
+        Rule    string      `json:"rule,omitempty"`
+        Pattern int         `json:"pattern,omitempty"`
+        Groups  []jsonGroup `json:"groups,omitempty"`
+        Before  []jsonLine  `json:"before,omitempty"`
+        After   []jsonLine  `json:"after,omitempty"`
+    }
+    jsonBinary struct {
+        Type       string `json:"type"`
+        File       string `json:"file"`
+        Offset     int64  `json:"offset"`
+        Text       string `json:"text"`
+        Hex        string `json:"hex"`
+        DumpOffset int64  `json:"dump_offset"`
+        Dump       string `json:"dump"`
+    }
+    jsonLine struct {
+        Line int    `json:"line,omitempty"`
+        Text string `json:"text"`
+    }
+    jsonGroup struct {
+        Name  string `json:"name"`
+        Text  string `json:"text"`
+        Start int    `json:"start"`
+        End   int    `json:"end"`
+    }
+    jsonCount struct {
+        Type  string `json:"type"`
+        File  string `json:"file"`
+        Count int    `json:"count"`
+    }
+    jsonFile struct {
+        Type string `json:"type"`
+        File string `json:"file"`
+    }
+    jsonEnd struct {
+        Type    string `json:"type"`
+        File    string `json:"file"`
+        Matches int    `json:"matches"`
+    }
+    jsonUnique struct {
+        Type  string `json:"type"`
+        Text  string `json:"text"`
+        Count int    `json:"count"`
+    }
+    jsonError struct {
+        Type    string `json:"type"`
+        File    string `json:"file"`
+        Op      string `json:"op"`
+        Errno   int    `json:"errno,omitempty"`
+        Message string `json:"message"`
+    }
+    jsonSummary struct {
+        Type         string         `json:"type"`
+        Files        int            `json:"files"`
+        Deduplicated int            `json:"deduplicated,omitempty"`
+        Matches      int            `json:"matches"`
+        Errors       int            `json:"errors"`
+        Failed       map[string]int `json:"failed,omitempty"`
+        Truncated    bool           `json:"truncated,omitempty"`
+    }
+)
+
+// printJSON writes a result as a JSON record. With -A, -B and -C the
+// context lines go into the records of their matches.
+func (p *printer) printJSON(result Result) {
+    if p.opts.withContext() && !p.opts.Passthru {
+        p.contextJSON(result)
+    } else {
+        p.encodeJSON(result, nil, nil)
+    }
+}
+
+// contextJSON collects the context lines of the matches. A context line
+// may be a line after one match and a line before the next one.
+func (p *printer) contextJSON(result Result) {
+    if result.Err != nil {
+        p.encodeJSON(result, nil, nil)
+        return
+    }
+    if p.pending != nil && (!result.Context || result.File != p.pending.File ||
+        len(p.after) == p.opts.After) {
+        p.encodeJSON(*p.pending, p.before, p.after)
+        p.pending = nil
+    }
+
+    switch {
+    case result.Context:
+        if p.pending != nil {
+            p.after = append(p.after, jsonLine{p.jsonLino(result.Line), result.Text})
+        }
+        if p.opts.Before > 0 {
+            if len(p.recent) == p.opts.Before {
+                p.recent = p.recent[1:]
+            }
+            p.recent = append(p.recent, result)
+        }
+    case result.Summary != nil:
+        p.encodeJSON(result, nil, nil)
+    default:
+        var before []jsonLine
+        for _, line := range p.recent {
+            if line.File == result.File && line.Line >= result.Line-p.opts.Before {
+                before = append(before, jsonLine{p.jsonLino(line.Line), line.Text})
+            }
+        }
+        p.recent = p.recent[:0]
+        p.pending, p.before, p.after = &result, before, nil
+        if p.opts.After == 0 {
+            p.encodeJSON(result, before, nil)
+            p.pending = nil
+        }
+    }
+}
+
+// encodeJSON writes a result as a JSON record, a match with the lines
+// before and after it
+func (p *printer) encodeJSON(result Result, before, after []jsonLine) {
+    p.block(result)
+    switch {
+    case result.Err != nil:
+        fe := result.Err
+        p.json.Encode(jsonError{"error", fe.File, fe.Op, fe.Errno, fe.Message})
+    case result.Summary != nil:
+        p.json.Encode(result.Summary)
+    case p.opts.UniqueCount:
+        p.json.Encode(jsonUnique{"unique", result.Text, result.Count})
+    case p.opts.FilesOnly:
+        p.json.Encode(jsonFile{"file", result.File})
+    case p.opts.CountOnly:
+        p.json.Encode(jsonCount{"count", result.File, result.Count})
+    case result.Binary:
+        p.json.Encode(binaryJSON(result))
+    case result.Context:
+        p.json.Encode(jsonMatch{Type: "context", File: result.File, Line: p.jsonLino(result.Line),
+            Text: result.Text})
+    default:
+        record := jsonMatch{Type: "match", File: result.File, Line: p.jsonLino(result.Line),
+            Column: p.column(result), Text: result.Text, Rule: result.Rule, Pattern: result.Pattern,
+            Before: before, After: after}
+        for _, group := range result.Groups {
+            record.Groups = append(record.Groups,
+                jsonGroup{group.Name, group.Text, group.Start, group.End})
+        }
+        p.json.Encode(record)
+    }
+}
+
+// column returns the column of the first match in the line of result,
+// counting bytes from 1, which vim and other editors jump to
+func (p *printer) column(result Result) int {
+    if result.Column > 0 || p.opts.OnlyMatching {
+        return result.Column
+    }
+    if locs := p.pat.findAll(result.Text, 1); locs != nil {
+        return locs[0][0] + 1
+    }
+    return 0
+}
+
+// jsonLino returns the line number of a JSON record, which is left
+// out with --no-line-number
+func (p *printer) jsonLino(lino int) int {
+    if !p.opts.LineNumbers {
+        return 0
+    }
+    return lino
+}
+
+// MarshalJSON encodes the summary as the record at the end of the
+// --json stream
+func (s *Summary) MarshalJSON() ([]byte, error) {
+    return json.Marshal(jsonSummary{"summary", s.Files, s.Deduplicated, s.Matches, s.Failures(), s.Errors, s.Truncated})
+}
+
+// block writes the begin and the end records around the matches of
+// a file in the --json stream. The collector passes on the results of
+// a file together, errors are no part of the blocks.
+func (p *printer) block(result Result) {
+    if result.Err != nil || p.opts.CountOnly || p.opts.FilesOnly {
+        return
+    }
+    if p.blockFile != "" && (result.Summary != nil || result.File != p.blockFile) {
+        p.json.Encode(jsonEnd{"end", p.blockFile, p.blockMatches})
+        p.blockFile = ""
+    }
+    if result.Summary != nil || result.File == "" {
+        return
+    }
+    if p.blockFile == "" {
+        p.json.Encode(jsonFile{"begin", result.File})
+        p.blockFile, p.blockMatches = result.File, 0
+    }
+    if !result.Context {
+        p.blockMatches++
+    }
+}
+
+// captureGroups returns the named groups of the first match of pat
+// in line, that took part in the match
+func captureGroups(pat *Pattern, line string) []Group {
+    locs := pat.findAll(line, 1)
+    if locs == nil {
+        return nil
+    }
+    loc := locs[0]
+    var groups []Group
+    for i, name := range pat.lineRx.SubexpNames() {
+        start, end := loc[2*i], loc[2*i+1]
+        if name == "" || start < 0 {
+            continue
+        }
+        groups = append(groups, Group{name, line[start:end], start, end})
+    }
+    return groups
+}
+
+// A formatPart is a piece of a --format template: either literal text,
+// or a placeholder for a field of the result
+type formatPart struct {
+    text  string // the literal text, if field is empty
+    field string // file, line, text, count or group
+    group string // the name of the group
+}
+
+// parseFormat parses a --format template. The placeholders are {file},
+// {line}, {text}, {count}, {rule} and {groups.name} for the named groups of rx,
+// "{{" and "}}" stand for literal braces.
+func parseFormat(spec string, rx *regexp.Regexp) ([]formatPart, error) {
+    var parts []formatPart
+    var text strings.Builder
+    for i := 0; i < len(spec); i++ {
+        switch {
+        case strings.HasPrefix(spec[i:], "{{"), strings.HasPrefix(spec[i:], "}}"):
+            text.WriteByte(spec[i])
+            i++
+        case spec[i] == '{':
+            end := strings.IndexByte(spec[i:], '}')
+            if end < 0 {
+                return nil, fmt.Errorf("unclosed placeholder at %q", spec[i:])
+            }
+            name := spec[i+1 : i+end]
+            part := formatPart{field: name}
+            switch {
+            case name == "file", name == "line", name == "text", name == "count", name == "rule":
+            case strings.HasPrefix(name, "groups."):
+                part.field, part.group = "group", strings.TrimPrefix(name, "groups.")
+                if rx.SubexpIndex(part.group) < 0 {
+                    return nil, fmt.Errorf("no group named %q in the regexp", part.group)
+                }
+            default:
+                return nil, fmt.Errorf("unknown placeholder {%s}", name)
+            }
+            if text.Len() > 0 {
+                parts = append(parts, formatPart{text: text.String()})
+                text.Reset()
+            }
+            parts = append(parts, part)
+            i += end
+        default:
+            text.WriteByte(spec[i])
+        }
+    }
+    if text.Len() > 0 {
+        parts = append(parts, formatPart{text: text.String()})
+    }
+    return parts, nil
+}
+
+// expandFormat fills in the template for a result
+func expandFormat(parts []formatPart, result Result) string {
+    var b strings.Builder
+    for _, part := range parts {
+        switch part.field {
+        case "":
+            b.WriteString(part.text)
+        case "file":
+            b.WriteString(result.File)
+        case "line":
+            if result.Line > 0 {
+                b.WriteString(strconv.Itoa(result.Line))
+            }
+        case "text":
+            b.WriteString(result.Text)
+        case "count":
+            b.WriteString(strconv.Itoa(result.Count))
+        case "rule":
+            b.WriteString(result.Rule)
+        case "group":
+            for _, group := range result.Groups {
+                if group.Name == part.group {
+                    b.WriteString(group.Text)
+                    break
+                }
+            }
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package grep
+
+// OSPath returns the path to hand to the operating system for path,
+// which is path itself here
+func OSPath(path string) string {
+    return path
+}
+
+// userPath puts the path the user knows back into errors about
+// a path returned by OSPath
+func userPath(err error, path string) error {
+    return err
+}
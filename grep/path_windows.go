@@ -0,0 +1,42 @@
+//go:build windows
+
+package grep
+
+import (
+    "errors"
+    "io/fs"
+    "path/filepath"
+    "strings"
+)
+
+// Paths this long need the \\?\ prefix, the limit is MAX_PATH less room
+// for a file name, like in the os package
+const maxShortPath = 248
+
+// OSPath returns the path to hand to the operating system for path:
+// long paths become absolute \\?\ paths, and long paths on a share
+// \\server\share\... become \\?\UNC\server\share\..., which both may
+// exceed MAX_PATH
+func OSPath(path string) string {
+    if len(path) < maxShortPath || strings.HasPrefix(path, `\\?\`) {
+        return path
+    }
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return path
+    }
+    if strings.HasPrefix(abs, `\\`) {
+        return `\\?\UNC\` + abs[2:]
+    }
+    return `\\?\` + abs
+}
+
+// userPath puts the path the user knows back into errors about
+// a path returned by OSPath
+func userPath(err error, path string) error {
+    var pathErr *fs.PathError
+    if errors.As(err, &pathErr) {
+        pathErr.Path = path
+    }
+    return err
+}
@@ -0,0 +1,275 @@
+package grep
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "regexp/syntax"
+    "strings"
+)
+
+// Pattern holds the regular expression compiled in the forms the
+// different search strategies need
+type Pattern struct {
+    lineRx  *regexp.Regexp // matches within a single line
+    chunkRx *regexp.Regexp // finds candidate lines in a chunk, nil if unsafe
+    literal []byte         // the whole pattern, if it is a plain string
+    fold    *foldFinder    // finds the pattern of -i -F, if it is ASCII
+    reject  *lineFilter    // rejects lines before the regexp, nil if it can't
+
+    // The names of the --preset rules or -e patterns of an alternation,
+    // and the groups around them
+    rules      []string
+    ruleGroups []int
+
+    opts *Options // the options of the search, with what follows from them
+}
+
+// Compile checks opts and compiles the pattern of a search with them:
+// the rules of the --preset, several -e expressions into one that tells
+// which of them matched, or a single expression. The pattern keeps a
+// copy of opts, with what follows from them.
+func Compile(opts Options, exprs ...string) (*Pattern, error) {
+    if err := opts.setup(); err != nil {
+        return nil, err
+    }
+    var pat *Pattern
+    var err error
+    switch {
+    case opts.Preset != "" && len(exprs) > 0:
+        return nil, errors.New("--preset and -e exclude each other")
+    case opts.Preset != "":
+        if pat, err = compilePreset(opts.Preset, &opts); err != nil {
+            return nil, err
+        }
+    case len(exprs) == 0:
+        return nil, errors.New("no pattern to search for")
+    case len(exprs) > 1:
+        if pat, err = compileExprs(exprs, &opts); err != nil {
+            return nil, fmt.Errorf("invalid regexp: %s", err)
+        }
+    default:
+        if pat, err = compilePattern(exprs[0], &opts); err != nil {
+            return nil, fmt.Errorf("invalid regexp: %s", err)
+        }
+    }
+    if err := checkBinary(pat); err != nil {
+        return nil, err
+    }
+    if opts.Format != "" {
+        if opts.format, err = parseFormat(opts.Format, pat.lineRx); err != nil {
+            return nil, fmt.Errorf("invalid format: %s", err)
+        }
+    }
+    return pat, nil
+}
+
+// Options returns the options of the search for the pattern, with what
+// follows from them, like -A and -B from -C
+func (pat *Pattern) Options() Options {
+    return *pat.opts
+}
+
+// compilePattern compiles expr in the chosen pattern syntax for matching
+// lines, and in multi-line mode for matching whole chunks of lines,
+// if that gives the same answers.
+func compilePattern(expr string, opts *Options) (*Pattern, error) {
+    rx, longest, err := translatePattern(expr, opts)
+    if err != nil {
+        return nil, err
+    }
+    pat, err := newPattern(rx, longest, opts)
+    if err != nil {
+        return nil, err
+    }
+    if opts.IgnoreCase && opts.FixedStrings && !opts.folding() {
+        pat.fold = newFoldFinder(expr)
+    }
+    return pat, nil
+}
+
+// match reports whether the pattern matches in line
+func (pat *Pattern) match(line []byte) bool {
+    if pat.opts.folding() {
+        line = foldLine(line, pat.opts.FoldAccents)
+    }
+    if pat.fold == nil {
+        if pat.reject != nil && pat.reject.rejects(line) {
+            return false
+        }
+        return pat.lineRx.Match(line)
+    }
+    if pat.fold.index(line) >= 0 {
+        return true
+    }
+    return pat.fold.unicode && !isASCII(line) && pat.lineRx.Match(line)
+}
+
+// weight is what a matching line adds to the count of its file: one,
+// or with --count-matches the number of matches in it, empty ones aside
+func (pat *Pattern) weight(line []byte) int {
+    if !pat.opts.CountMatches {
+        return 1
+    }
+    if pat.opts.folding() {
+        line = foldLine(line, pat.opts.FoldAccents)
+    }
+    n := 0
+    for _, loc := range pat.lineRx.FindAllIndex(line, -1) {
+        if loc[0] != loc[1] {
+            n++
+        }
+    }
+    return n
+}
+
+// findFold reports whether the foldFinder alone finds the candidate
+// lines of the pattern, without the regexp
+func (pat *Pattern) findFold() bool {
+    return pat.fold != nil && !pat.fold.unicode
+}
+
+// compileExprs compiles several -e patterns in the chosen pattern syntax
+// into one, which matches a line in a single pass and tells which of
+// them matched
+func compileExprs(exprs []string, opts *Options) (*Pattern, error) {
+    translated := make([]string, len(exprs))
+    longest := false
+    for i, expr := range exprs {
+        var err error
+        if translated[i], longest, err = translatePattern(expr, opts); err != nil {
+            return nil, fmt.Errorf("%s: %s", expr, err)
+        }
+    }
+    return compileAlternatives(exprs, translated, longest, opts)
+}
+
+// compileAlternatives compiles the RE2 expressions exprs into an
+// alternation with a group around each of them, named by names
+func compileAlternatives(names, exprs []string, longest bool, opts *Options) (*Pattern, error) {
+    alternatives := make([]string, len(exprs))
+    groups := make([]int, len(exprs))
+    group := 1
+    for i, expr := range exprs {
+        rx, err := regexp.Compile(expr)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", names[i], err)
+        }
+        alternatives[i] = "(" + expr + ")"
+        groups[i] = group
+        group += 1 + rx.NumSubexp()
+    }
+
+    pat, err := newPattern(strings.Join(alternatives, "|"), longest, opts)
+    if err != nil {
+        return nil, err
+    }
+    pat.rules, pat.ruleGroups = names, groups
+    return pat, nil
+}
+
+// rule returns the index, counting from 1, of the alternative that
+// matches first in text, or 0 if the pattern isn't an alternation
+func (pat *Pattern) rule(text string) int {
+    if pat.rules == nil {
+        return 0
+    }
+    locs := pat.findAll(text, 1)
+    if locs == nil {
+        return 0
+    }
+    return pat.ruleOf(locs[0])
+}
+
+// findAll returns the submatch indexes of the first n matches in line,
+// like FindAllStringSubmatchIndex. With --fold and --fold-accents the
+// folded line is matched, and the indexes are those in line.
+func (pat *Pattern) findAll(line string, n int) [][]int {
+    if !pat.opts.folding() {
+        return pat.lineRx.FindAllStringSubmatchIndex(line, n)
+    }
+    folded, offsets := foldMapped(line, pat.opts.FoldAccents)
+    locs := pat.lineRx.FindAllStringSubmatchIndex(folded, n)
+    for _, loc := range locs {
+        for i := 0; i+1 < len(loc); i += 2 {
+            if loc[i] >= 0 {
+                loc[i], loc[i+1] = unfoldSpan(offsets, loc[i], loc[i+1])
+            }
+        }
+    }
+    return locs
+}
+
+// ruleOf returns the index, counting from 1, of the alternative that
+// took part in the match with the submatch indexes loc
+func (pat *Pattern) ruleOf(loc []int) int {
+    for i, group := range pat.ruleGroups {
+        if loc[2*group] >= 0 {
+            return i + 1
+        }
+    }
+    return 0
+}
+
+// newPattern compiles the RE2 expression expr for the search with opts,
+// with leftmost-longest matching, if longest is set, and ignoring case
+// with -i
+func newPattern(expr string, longest bool, opts *Options) (*Pattern, error) {
+    if opts.folding() {
+        // The lines are folded before they are matched
+        var err error
+        if expr, err = foldPattern(expr, opts.FoldAccents); err != nil {
+            return nil, err
+        }
+    }
+    if opts.IgnoreCase || opts.folding() {
+        expr = "(?i)" + expr
+    }
+    lineRx, err := regexp.Compile(expr)
+    if err != nil {
+        return nil, err
+    }
+    if longest {
+        lineRx.Longest()
+    }
+    pat := &Pattern{lineRx: lineRx, opts: opts}
+    prefix, complete := lineRx.LiteralPrefix()
+    if complete && prefix != "" && !strings.ContainsAny(prefix, "\r\n") && !opts.folding() {
+        pat.literal = []byte(prefix)
+    }
+    pat.reject = newLineFilter(expr, prefix != "")
+    if chunkable(expr) && !opts.folding() {
+        pat.chunkRx = regexp.MustCompile("(?m)" + expr)
+        if longest {
+            pat.chunkRx.Longest()
+        }
+    }
+    return pat, nil
+}
+
+// chunkable reports whether expr in multi-line mode finds every line
+// that expr matches on its own. That's not the case for \A and \z, which
+// never match at a line boundary within a chunk, and for $, which doesn't
+// match before the \r of a \r\n line end.
+func chunkable(expr string) bool {
+    re, err := syntax.Parse("(?m)"+expr, syntax.Perl)
+    if err != nil {
+        return false
+    }
+    return !hasOp(re, syntax.OpBeginText, syntax.OpEndText, syntax.OpEndLine)
+}
+
+// hasOp reports whether any node of the syntax tree is one of ops
+func hasOp(re *syntax.Regexp, ops ...syntax.Op) bool {
+    for _, op := range ops {
+        if re.Op == op {
+            return true
+        }
+    }
+    for _, sub := range re.Sub {
+        if hasOp(sub, ops...) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,74 @@
+package grep
+
+import (
+    "os"
+)
+
+// strategy is the way a single file is searched
+type strategy int
+
+const (
+    autoStrategy  strategy = iota // let the planner decide
+    bufioStrategy                 // read and match line by line
+    mmapStrategy                  // map the file and jump to candidate lines
+    chunkStrategy                 // match large chunks, only for -c and -l
+)
+
+// strategies maps the --strategy names to the strategies
+var strategies = map[string]strategy{
+    "auto":    autoStrategy,
+    "bufio":   bufioStrategy,
+    "mmap":    mmapStrategy,
+    "chunked": chunkStrategy,
+}
+
+// Files smaller than this aren't worth mapping
+const mmapMinSize = 1 << 20
+
+// plan picks the strategy for a file from its size, the pattern and
+// the output mode. A strategy forced by --strategy is used, whenever
+// it can search the file at all.
+func plan(info os.FileInfo, pat *Pattern, memory *budget) strategy {
+    if len(pat.opts.delimiter) != 1 || pat.opts.delimiter[0] != '\n' || !pat.opts.Lines.all() || pat.opts.withContext() || pat.opts.folding() {
+        // Only the line reader knows about other record delimiters,
+        // counts the lines of a --line-range, keeps context lines and
+        // folds the lines for --fold
+        return bufioStrategy
+    }
+
+    counting := pat.opts.CountOnly || pat.opts.FilesOnly
+    chunkOK := counting && pat.chunkRx != nil
+    // The pages of a mapping are read behind the back of --io-limit,
+    // and of --watchdog, which would take the file for stuck
+    mapOK := mmapSupported && pat.opts.diskRate == nil && pat.opts.Watchdog == 0 && info.Mode().IsRegular() &&
+        info.Size() > 0 && info.Size() <= memory.mapLimit(pat.opts.workers())
+
+    switch strategies[pat.opts.Strategy] {
+    case bufioStrategy:
+        return bufioStrategy
+    case mmapStrategy:
+        if mapOK {
+            return mmapStrategy
+        }
+        return bufioStrategy
+    case chunkStrategy:
+        if chunkOK {
+            return chunkStrategy
+        }
+        return bufioStrategy
+    }
+
+    big := info.Size() >= mmapMinSize
+    switch {
+    case chunkOK && mapOK && big:
+        // Mapping saves copying the data into the chunk buffer
+        return mmapStrategy
+    case chunkOK:
+        return chunkStrategy
+    case mapOK && big && (pat.literal != nil || pat.findFold() || pat.chunkRx != nil):
+        // Mapping pays off, if we can jump from candidate to candidate
+        // instead of matching every single line
+        return mmapStrategy
+    }
+    return bufioStrategy
+}
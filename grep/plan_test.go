@@ -0,0 +1,44 @@
+package grep
+
+import (
+    "io/fs"
+    "testing"
+    "testing/fstest"
+)
+
+func TestPlan(t *testing.T) {
+    if !mmapSupported {
+        t.Skip("no mmap on this system")
+    }
+    fsys := fstest.MapFS{
+        "small": {Data: []byte("foo\n")},
+        "big":   {Data: make([]byte, mmapMinSize)},
+    }
+    tests := []struct {
+        args  []string
+        fname string
+        want  strategy
+    }{
+        {[]string{"foo"}, "small", bufioStrategy},
+        {[]string{"foo"}, "big", mmapStrategy},
+        {[]string{"-c", "foo"}, "small", chunkStrategy},
+        {[]string{"-c", "foo"}, "big", mmapStrategy},
+        {[]string{"-c", "--strategy", "bufio", "foo"}, "big", bufioStrategy},
+        {[]string{"-A", "1", "foo"}, "big", bufioStrategy},
+        {[]string{"--fold", "foo"}, "big", bufioStrategy},
+        // The mapped pages are read beyond the limit and the watchdog
+        {[]string{"--io-limit", "1M", "foo"}, "big", bufioStrategy},
+        {[]string{"-c", "--watchdog", "1s", "foo"}, "big", chunkStrategy},
+        {[]string{"--watchdog", "1s", "foo"}, "big", bufioStrategy},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.args...)
+        info, err := fs.Stat(fsys, test.fname)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := plan(info, pat, newBudget(0)); got != test.want {
+            t.Errorf("%q on %s: got strategy %d, want %d", test.args, test.fname, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,182 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The first bytes of the error output of --pre that go into the error
+const maxPreStderr = 512
+
+// searchPre searches the output of the --pre command for the file.
+// With --pre-cache-dir the output is kept by the hash of the file, and
+// only converted again, when the file changes.
+func (job Job) searchPre(ctx context.Context, file *os.File, pat *Pattern,
+    found chan<- Result) error {
+    if job.opts.PreCacheDir == "" {
+        job.opts.Stats.file()
+        var count int
+        err := runPre(ctx, job.opts.Pre, job.fname, func(out io.Reader) (err error) {
+            count, err = job.scanStream(ctx, out, pat, found)
+            return err
+        })
+        if err != nil || ctx.Err() != nil {
+            return err
+        }
+        job.sendCount(ctx, found, count)
+        return nil
+    }
+
+    key, err := preKey(file, job.opts.Pre)
+    if err != nil {
+        return &fs.PathError{Op: "read", Path: job.fname, Err: err}
+    }
+    cached := filepath.Join(job.opts.PreCacheDir, key+".txt")
+    if _, err := os.Stat(cached); err != nil {
+        if err := job.convert(ctx, cached); err != nil {
+            return err
+        }
+    } else {
+        // The modification time tells the least recently used entries
+        now := time.Now()
+        os.Chtimes(cached, now, now)
+    }
+
+    text, release, err := openFile(ctx, cached)
+    if err != nil {
+        return err
+    }
+    defer release()
+    defer text.Close()
+    info, err := text.Stat()
+    if err != nil {
+        return err
+    }
+    return job.scanFile(ctx, text, info, pat, found)
+}
+
+// convert writes the output of the --pre command for the file to the
+// cache entry cached. A failing command leaves no entry behind.
+func (job Job) convert(ctx context.Context, cached string) error {
+    tmp, err := os.CreateTemp(job.opts.PreCacheDir, ".pre-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    err = runPre(ctx, job.opts.Pre, job.fname, func(out io.Reader) error {
+        _, err := io.Copy(tmp, out)
+        return err
+    })
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), cached); err != nil {
+        return err
+    }
+    evictPre(job.opts.PreCacheDir, int64(job.opts.PreCacheSize))
+    return nil
+}
+
+// runPre runs the --pre command with the path of fname and passes its
+// output to read. The rest of the output, that read leaves, is skipped.
+func runPre(ctx context.Context, command, fname string, read func(io.Reader) error) error {
+    cmd := exec.CommandContext(ctx, command, OSPath(fname))
+    stderr := &limitedBuffer{max: maxPreStderr}
+    cmd.Stderr = stderr
+    out, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return &fs.PathError{Op: "pre", Path: fname, Err: err}
+    }
+    readErr := read(out)
+    io.Copy(io.Discard, out)
+    if err := cmd.Wait(); err != nil {
+        if ctx.Err() != nil {
+            return nil
+        }
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            err = fmt.Errorf("%s: %s", err, msg)
+        }
+        return &fs.PathError{Op: "pre", Path: fname, Err: err}
+    }
+    return readErr
+}
+
+// preKey returns the name of the cache entry for the contents of file,
+// which depends on the --pre command too
+func preKey(file *os.File, command string) (string, error) {
+    h := sha256.New()
+    io.WriteString(h, command+"\x00")
+    if _, err := io.Copy(h, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// The workers evict one at a time
+var evictMu sync.Mutex
+
+// evictPre removes the least recently used entries of the cache dir,
+// until the rest fits into limit bytes
+func evictPre(dir string, limit int64) {
+    evictMu.Lock()
+    defer evictMu.Unlock()
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return
+    }
+    var infos []fs.FileInfo
+    var total int64
+    for _, entry := range entries {
+        if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".txt") {
+            continue
+        }
+        if info, err := entry.Info(); err == nil {
+            infos = append(infos, info)
+            total += info.Size()
+        }
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].ModTime().Before(infos[j].ModTime())
+    })
+    for _, info := range infos {
+        if total <= limit {
+            return
+        }
+        err := os.Remove(filepath.Join(dir, info.Name()))
+        if err == nil || errors.Is(err, fs.ErrNotExist) {
+            total -= info.Size()
+        }
+    }
+}
+
+// limitedBuffer keeps the first max bytes written to it
+type limitedBuffer struct {
+    bytes.Buffer
+    max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+    if room := b.max - b.Len(); room > 0 {
+        b.Buffer.Write(p[:min(room, len(p))])
+    }
+    return len(p), nil
+}
@@ -0,0 +1,63 @@
+package grep
+
+import (
+    "context"
+)
+
+// prefetcher warms the page cache for the files queued for the workers,
+// so that slow disks and network file systems keep them busy. It works
+// ahead by at most --prefetch files, and skips files, when it falls
+// behind, rather than slowing down the dispatcher.
+type prefetcher struct {
+    queue chan string
+}
+
+// newPrefetcher starts n goroutines prefetching files until the context
+// is done, or returns nil for n = 0. With --io-limit there is no
+// prefetching, the reads ahead would get past the limit.
+func newPrefetcher(ctx context.Context, n int, rate *ioLimit) *prefetcher {
+    if n <= 0 || rate != nil {
+        return nil
+    }
+    p := &prefetcher{queue: make(chan string, n)}
+    for i := 0; i < n; i++ {
+        go func() {
+            for {
+                select {
+                case fname := <-p.queue:
+                    prefetchFile(ctx, fname)
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }()
+    }
+    return p
+}
+
+// add queues a file for prefetching, unless the queue is full
+func (p *prefetcher) add(fname string) {
+    if p == nil || IsURL(fname) || IsStdin(fname) {
+        return
+    }
+    select {
+    case p.queue <- fname:
+    default:
+    }
+}
+
+// prefetchFile asks the system to read the file ahead. Errors don't
+// matter here, the worker reports them.
+func prefetchFile(ctx context.Context, fname string) {
+    file, release, err := openFile(ctx, fname)
+    if err != nil {
+        return
+    }
+    defer release()
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil || !info.Mode().IsRegular() {
+        return
+    }
+    readAhead(ctx, file, info.Size())
+}
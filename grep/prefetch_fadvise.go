@@ -0,0 +1,18 @@
+//go:build linux && (amd64 || arm64)
+
+package grep
+
+import (
+    "context"
+    "os"
+    "syscall"
+)
+
+// The advice that the whole file will be needed soon
+const fadvWillNeed = 3
+
+// readAhead has the kernel read the file into the page cache in the
+// background with posix_fadvise(POSIX_FADV_WILLNEED)
+func readAhead(ctx context.Context, file *os.File, size int64) {
+    syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, uintptr(size), fadvWillNeed, 0, 0)
+}
@@ -0,0 +1,23 @@
+//go:build !(linux && (amd64 || arm64))
+
+package grep
+
+import (
+    "context"
+    "io"
+    "os"
+)
+
+// The size of the reads of readAhead
+const readAheadSize = 256 << 10
+
+// readAhead reads the file sequentially, so that it is in the page
+// cache when the worker gets to it. It stops when the context is done.
+func readAhead(ctx context.Context, file *os.File, size int64) {
+    buf := make([]byte, readAheadSize)
+    for ctx.Err() == nil {
+        if _, err := io.ReadFull(file, buf); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,20 @@
+package grep
+
+import (
+    "context"
+    "testing"
+)
+
+// The reads ahead would get past --io-limit
+func TestPrefetchIOLimit(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    pat := setOptions(t, "--prefetch", "2", "x")
+    if newPrefetcher(ctx, pat.opts.Prefetch, pat.opts.diskRate) == nil {
+        t.Error("no prefetcher with --prefetch")
+    }
+    pat = setOptions(t, "--prefetch", "2", "--io-limit", "1M", "x")
+    if newPrefetcher(ctx, pat.opts.Prefetch, pat.opts.diskRate) != nil {
+        t.Error("a prefetcher with --io-limit")
+    }
+}
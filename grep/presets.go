@@ -0,0 +1,77 @@
+package grep
+
+import (
+    _ "embed"
+    "fmt"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// The rule set of the pattern packs
+//
+//go:embed presets.txt
+var presetRules string
+
+// A rule is a named regexp of a pattern pack
+type rule struct {
+    pack string
+    name string
+    expr string
+}
+
+// parsePresets parses the embedded rule set
+func parsePresets() ([]rule, error) {
+    var rules []rule
+    for i, line := range strings.Split(presetRules, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || line[0] == '#' {
+            continue
+        }
+        fields := strings.Fields(line)
+        if len(fields) != 3 {
+            return nil, fmt.Errorf("presets.txt:%d: want <pack> <rule> <regexp>", i+1)
+        }
+        rules = append(rules, rule{fields[0], fields[1], fields[2]})
+    }
+    return rules, nil
+}
+
+// presetPacks returns the names of the pattern packs, sorted
+func presetPacks(rules []rule) []string {
+    var packs []string
+    seen := make(map[string]bool)
+    for _, r := range rules {
+        if !seen[r.pack] {
+            seen[r.pack] = true
+            packs = append(packs, r.pack)
+        }
+    }
+    sort.Strings(packs)
+    return packs
+}
+
+// compilePreset compiles the rules of the comma separated packs in spec
+// into a single pattern, so that a match can be tagged with its rule
+func compilePreset(spec string, opts *Options) (*Pattern, error) {
+    all, err := parsePresets()
+    if err != nil {
+        return nil, err
+    }
+    packs := strings.Split(spec, ",")
+    for _, pack := range packs {
+        if known := presetPacks(all); !slices.Contains(known, pack) {
+            return nil, fmt.Errorf("unknown preset %q, choose from %s", pack,
+                strings.Join(known, ", "))
+        }
+    }
+
+    var names, exprs []string
+    for _, r := range all {
+        if slices.Contains(packs, r.pack) {
+            names = append(names, r.name)
+            exprs = append(exprs, r.expr)
+        }
+    }
+    return compileAlternatives(names, exprs, false, opts)
+}
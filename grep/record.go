@@ -0,0 +1,79 @@
+package grep
+
+import (
+    "encoding/hex"
+    "encoding/json"
+)
+
+// ParseRecord turns a record of the --json stream back into results,
+// a match record into the match and its context lines. The begin and
+// end records are left out, the printer makes them again.
+func ParseRecord(record json.RawMessage) ([]Result, error) {
+    var r struct {
+        Type      string         `json:"type"`
+        File      string         `json:"file"`
+        Line      int            `json:"line"`
+        Column    int            `json:"column"`
+        Text      string         `json:"text"`
+        Rule      string         `json:"rule"`
+        Pattern   int            `json:"pattern"`
+        Count     int            `json:"count"`
+        Op        string         `json:"op"`
+        Errno     int            `json:"errno"`
+        Message   string         `json:"message"`
+        Files     int            `json:"files"`
+        Dedup     int            `json:"deduplicated"`
+        Matches   int            `json:"matches"`
+        Failed    map[string]int `json:"failed"`
+        Truncated bool           `json:"truncated"`
+        Before    []jsonLine     `json:"before"`
+        After     []jsonLine     `json:"after"`
+        Groups    []jsonGroup    `json:"groups"`
+        Offset    int64          `json:"offset"`
+        Hex       string         `json:"hex"`
+        DumpAt    int64          `json:"dump_offset"`
+        Dump      string         `json:"dump"`
+    }
+    if err := json.Unmarshal(record, &r); err != nil {
+        return nil, err
+    }
+    switch r.Type {
+    case "match":
+        var results []Result
+        for _, line := range r.Before {
+            results = append(results, Result{File: r.File, Line: line.Line, Text: line.Text, Context: true})
+        }
+        match := Result{File: r.File, Line: r.Line, Text: r.Text, Column: r.Column,
+            Rule: r.Rule, Pattern: r.Pattern}
+        for _, group := range r.Groups {
+            match.Groups = append(match.Groups, Group{group.Name, group.Text, group.Start, group.End})
+        }
+        results = append(results, match)
+        for _, line := range r.After {
+            results = append(results, Result{File: r.File, Line: line.Line, Text: line.Text, Context: true})
+        }
+        return results, nil
+    case "context":
+        return []Result{{File: r.File, Line: r.Line, Text: r.Text, Context: true}}, nil
+    case "binary":
+        text, err := hex.DecodeString(r.Hex)
+        if err != nil {
+            return nil, err
+        }
+        dump, err := hex.DecodeString(r.Dump)
+        if err != nil {
+            return nil, err
+        }
+        return []Result{{File: r.File, Text: string(text), Binary: true, Offset: r.Offset,
+            DumpOffset: r.DumpAt, Dump: dump}}, nil
+    case "count", "file":
+        return []Result{{File: r.File, Count: r.Count}}, nil
+    case "error":
+        return []Result{{Err: &FileError{File: r.File, Op: r.Op, Errno: r.Errno, Message: r.Message,
+            Text: r.Op + " " + r.File + ": " + r.Message}}}, nil
+    case "summary":
+        return []Result{{Summary: &Summary{Files: r.Files, Deduplicated: r.Dedup, Matches: r.Matches,
+            Errors: r.Failed, Truncated: r.Truncated}}}, nil
+    }
+    return nil, nil
+}
@@ -0,0 +1,186 @@
+package grep
+
+import (
+    "bytes"
+    "regexp/syntax"
+    "unicode"
+    "unicode/utf8"
+)
+
+// byteSet is a set of bytes, indexed by the byte
+type byteSet [256]bool
+
+// lineFilter rejects lines the pattern can't match with a few byte
+// comparisons, before the regexp looks at them. It is worked out once
+// from the syntax tree of the pattern: a match anchored at the start of
+// the line must begin with the literal prefix, and any match begins
+// with one of the first bytes.
+type lineFilter struct {
+    anchored bool     // the matches start at the beginning of the line
+    prefix   []byte   // with anchored, the bytes all matches start with
+    first    *byteSet // the bytes a match can start with, nil if any
+    scan     bool     // look for the first bytes in the whole line
+}
+
+// newLineFilter analyzes the RE2 expression expr, which the regexp of
+// the pattern already accepted. It returns nil, if no line can be
+// rejected up front, e.g. when the pattern matches the empty string.
+// A line that has none of the first bytes is only looked at, when the
+// regexp doesn't find its matches by a literal prefix anyway.
+func newLineFilter(expr string, literalPrefix bool) *lineFilter {
+    re, err := syntax.Parse(expr, syntax.Perl)
+    if err != nil {
+        return nil
+    }
+    re = re.Simplify()
+    f := &lineFilter{}
+    f.prefix, f.anchored = anchoredPrefix(re)
+    if first, nullable := firstBytes(re); !nullable {
+        f.first = first
+    }
+    f.scan = !f.anchored && f.first != nil && !literalPrefix
+    if len(f.prefix) == 0 && (f.first == nil || !f.anchored && !f.scan) {
+        return nil
+    }
+    return f
+}
+
+// rejects reports whether the pattern can't match in line
+func (f *lineFilter) rejects(line []byte) bool {
+    if f.anchored {
+        if !bytes.HasPrefix(line, f.prefix) {
+            return true
+        }
+        return f.first != nil && (len(line) == 0 || !f.first[line[0]])
+    }
+    if !f.scan {
+        return false
+    }
+    for _, c := range line {
+        if f.first[c] {
+            return false
+        }
+    }
+    return true
+}
+
+// anchoredPrefix returns the literal runes at the start of a pattern
+// that begins with \A or ^, which match at the beginning of the line
+// only. Literals ignoring case end the prefix.
+func anchoredPrefix(re *syntax.Regexp) ([]byte, bool) {
+    for re.Op == syntax.OpCapture {
+        re = re.Sub[0]
+    }
+    if re.Op != syntax.OpConcat || re.Sub[0].Op != syntax.OpBeginText {
+        return nil, false
+    }
+    var prefix []byte
+    for _, sub := range re.Sub[1:] {
+        for sub.Op == syntax.OpCapture {
+            sub = sub.Sub[0]
+        }
+        if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+            break
+        }
+        for _, r := range sub.Rune {
+            prefix = utf8.AppendRune(prefix, r)
+        }
+    }
+    return prefix, true
+}
+
+// firstBytes returns the bytes a match of re can start with, nil if
+// that can be any byte, and whether re can match the empty string, in
+// which case the bytes after it can come first too
+func firstBytes(re *syntax.Regexp) (*byteSet, bool) {
+    switch re.Op {
+    case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpBeginText,
+        syntax.OpEndLine, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+        return &byteSet{}, true
+    case syntax.OpLiteral:
+        set := &byteSet{}
+        addRune(set, re.Rune[0], re.Flags&syntax.FoldCase != 0)
+        return set, false
+    case syntax.OpCharClass:
+        set := &byteSet{}
+        for i := 0; i+1 < len(re.Rune); i += 2 {
+            addRange(set, re.Rune[i], re.Rune[i+1])
+        }
+        return set, false
+    case syntax.OpCapture, syntax.OpPlus:
+        return firstBytes(re.Sub[0])
+    case syntax.OpStar, syntax.OpQuest:
+        set, _ := firstBytes(re.Sub[0])
+        return set, true
+    case syntax.OpRepeat:
+        set, nullable := firstBytes(re.Sub[0])
+        return set, nullable || re.Min == 0
+    case syntax.OpConcat:
+        set := &byteSet{}
+        for _, sub := range re.Sub {
+            first, nullable := firstBytes(sub)
+            if first == nil {
+                return nil, false
+            }
+            union(set, first)
+            if !nullable {
+                return set, false
+            }
+        }
+        return set, true
+    case syntax.OpAlternate:
+        set, nullable := &byteSet{}, false
+        for _, sub := range re.Sub {
+            first, empty := firstBytes(sub)
+            if first == nil {
+                return nil, false
+            }
+            union(set, first)
+            nullable = nullable || empty
+        }
+        return set, nullable
+    }
+    // A single character of any kind
+    return nil, false
+}
+
+// addRune adds the first byte of r in UTF-8, and with fold the first
+// bytes of the runes that are the same ignoring case, like K and the
+// Kelvin sign
+func addRune(set *byteSet, r rune, fold bool) {
+    addRange(set, r, r)
+    if fold {
+        for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+            set[firstByte(f)] = true
+        }
+    }
+}
+
+// addRange adds the first bytes of the runes lo to hi in UTF-8, which
+// are in the same order as the runes. The regexp reads invalid UTF-8 as
+// utf8.RuneError, so any byte above ASCII can start a match of it.
+func addRange(set *byteSet, lo, hi rune) {
+    from, to := int(firstByte(lo)), int(firstByte(hi))
+    if lo <= utf8.RuneError && utf8.RuneError <= hi {
+        from, to = min(from, utf8.RuneSelf), max(to, 0xff)
+    }
+    for b := from; b <= to; b++ {
+        set[b] = true
+    }
+}
+
+// firstByte returns the first byte of r in UTF-8
+func firstByte(r rune) byte {
+    var buf [utf8.UTFMax]byte
+    utf8.EncodeRune(buf[:], r)
+    return buf[0]
+}
+
+// union adds the bytes of other to set
+func union(set, other *byteSet) {
+    for b, ok := range other {
+        if ok {
+            set[b] = true
+        }
+    }
+}
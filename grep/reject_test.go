@@ -0,0 +1,85 @@
+package grep
+
+import (
+    "math/rand"
+    "regexp"
+    "testing"
+)
+
+// rejectExprs are patterns with anchors, folding, classes, repetitions
+// and empty matches
+var rejectExprs = []string{
+    "foo", "^foo", `\Afoo`, "^(foo|bar)", "^foo|bar", "foo|bar", "(?i)foo", "(?i)k", "(?i)ſ",
+    "[a-c]x", "[^a]", "é", "[é-ü]", ".foo", "x*foo", "x?y", "(ab)+c", "a{0,2}b", "a{2}",
+    `\bfoo`, "^$", "^", "$", "(?m)^b", "^[0-9]+$", `\x{FFFD}`, `[\x{80}-\x{ff}]`, "(?s).", "(?:)",
+    "^(?i)straße", "^\xe2\x82\xac", "^(a|ab)c", "^a*b",
+}
+
+// rejectLines are lines the filter could get wrong: empty, invalid
+// UTF-8, and the case foldings outside ASCII
+var rejectLines = []string{
+    "", "foo", "xfoo", "FOO", "fOo bar", "bar", "K", "K", "s", "S", "ſ", "é", "ü",
+    "\xff", "\xc3", "\xe2\x82", "\xe2\x82\xac", "ab", "abc", "aab", "b", "xy", "y", "123", "12a",
+    "STRASSE", "straße", "Straße", "\x00foo", "éfoo",
+}
+
+// The filter never rejects a line the pattern matches
+func TestLineFilterSound(t *testing.T) {
+    random := rand.New(rand.NewSource(1))
+    alphabet := []string{"a", "b", "c", "f", "o", "x", "K", "K", "é", "\xff", "\xe2", " ", "0"}
+    lines := append([]string(nil), rejectLines...)
+    for i := 0; i < 2000; i++ {
+        line := ""
+        for n := random.Intn(6); n > 0; n-- {
+            line += alphabet[random.Intn(len(alphabet))]
+        }
+        lines = append(lines, line)
+    }
+    for _, expr := range rejectExprs {
+        rx := regexp.MustCompile(expr)
+        for _, literalPrefix := range []bool{false, true} {
+            f := newLineFilter(expr, literalPrefix)
+            if f == nil {
+                continue
+            }
+            for _, line := range lines {
+                if f.rejects([]byte(line)) && rx.MatchString(line) {
+                    t.Errorf("%q rejects %q, which it matches", expr, line)
+                }
+            }
+        }
+    }
+}
+
+// The filter rejects the lines it can tell from the first bytes
+func TestLineFilterRejects(t *testing.T) {
+    tests := []struct {
+        expr   string
+        reject []string
+    }{
+        {"^foo", []string{"", "xfoo", "fo", "FOO"}},
+        {"^(foo|bar)", []string{"", "xfoo", "z foo"}},
+        {"foo|bar", []string{"", "xyz", "FOO"}},
+        {"(?i)foo", []string{"", "xyz", "oo"}},
+        {"[a-c]x", []string{"", "xyz", "d"}},
+        {"é", []string{"", "e", "abc"}},
+    }
+    for _, test := range tests {
+        f := newLineFilter(test.expr, false)
+        if f == nil {
+            t.Errorf("%q: no filter", test.expr)
+            continue
+        }
+        for _, line := range test.reject {
+            if !f.rejects([]byte(line)) {
+                t.Errorf("%q doesn't reject %q", test.expr, line)
+            }
+        }
+    }
+    // A pattern that matches the empty string can't reject anything
+    for _, expr := range []string{"x*", "^", "(?:)", "a{0,2}"} {
+        if f := newLineFilter(expr, false); f != nil {
+            t.Errorf("%q: got a filter, want none", expr)
+        }
+    }
+}
@@ -0,0 +1,56 @@
+package grep
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "sync/atomic"
+)
+
+// ErrScanLimit tells that --max-bytes-scanned stopped the search
+var ErrScanLimit = errors.New("--max-bytes-scanned reached, the results are incomplete")
+
+// scanLimit is the number of bytes all workers together may read for
+// --max-bytes-scanned. When it is spent, the search is cancelled.
+// A nil *scanLimit has no limit.
+type scanLimit struct {
+    limit  int64
+    used   atomic.Int64
+    spent  atomic.Bool
+    cancel context.CancelFunc
+}
+
+// newScanLimit returns a limit of n bytes calling cancel, once it is
+// spent, or nil for n = 0
+func newScanLimit(n int64, cancel context.CancelFunc) *scanLimit {
+    if n <= 0 {
+        return nil
+    }
+    return &scanLimit{limit: n, cancel: cancel}
+}
+
+// take returns how many of the next n bytes may still be scanned
+func (l *scanLimit) take(n int) int {
+    if l == nil {
+        return n
+    }
+    used := l.used.Add(int64(n))
+    if used <= l.limit {
+        return n
+    }
+    if !l.spent.Swap(true) {
+        l.cancel()
+    }
+    return int(max(0, l.limit-(used-int64(n))))
+}
+
+// reached reports whether the limit stopped the search
+func (l *scanLimit) reached() bool {
+    return l != nil && l.spent.Load()
+}
+
+// wholeLines cuts data after its last newline, so that the line cut
+// off by the limit isn't matched
+func wholeLines(data []byte) []byte {
+    return data[:bytes.LastIndexByte(data, '\n')+1]
+}
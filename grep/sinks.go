@@ -0,0 +1,76 @@
+package grep
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "strconv"
+)
+
+// HeadingSink prints the results of pat grouped by file, each file name
+// on a line of its own before its lines, like rg --heading
+func HeadingSink(w io.Writer, pat *Pattern) Sink {
+    opts := pat.opts
+    out := &errWriter{w: w}
+    last := ""
+    return func(result Result) error {
+        switch {
+        case result.Err != nil:
+            opts.logError(result.Err)
+        case result.Summary != nil:
+        default:
+            if result.File != last {
+                if last != "" {
+                    fmt.Fprintln(out)
+                }
+                fmt.Fprintln(out, opts.theme.colorFname(result.File))
+                last = result.File
+            }
+            sep := opts.FieldSeparator
+            if result.Context {
+                sep = "-"
+            }
+            lino := ""
+            if opts.LineNumbers {
+                lino = opts.theme.colorLino(result.Line) + opts.theme.colorSep(sep)
+            }
+            fmt.Fprintf(out, "%s%s\n", lino, result.Text)
+        }
+        return out.err
+    }
+}
+
+// VimgrepSink prints the results of pat as file:line:column:text, which
+// vim reads with :cfile and friends. Context lines are left out.
+func VimgrepSink(w io.Writer, pat *Pattern) Sink {
+    out := &errWriter{w: w}
+    return func(result Result) error {
+        switch {
+        case result.Err != nil:
+            pat.opts.logError(result.Err)
+        case result.Summary != nil || result.Context:
+        default:
+            fmt.Fprintf(out, "%s:%d:%d:%s\n", result.File, result.Line, max(1, result.Column), result.Text)
+        }
+        return out.err
+    }
+}
+
+// CSVSink prints the results of pat as CSV, with a header row. Context
+// lines are left out.
+func CSVSink(w io.Writer, pat *Pattern) Sink {
+    out := csv.NewWriter(w)
+    out.Write([]string{"file", "line", "column", "text", "rule"})
+    return func(result Result) error {
+        switch {
+        case result.Err != nil:
+            pat.opts.logError(result.Err)
+        case result.Summary != nil:
+            out.Flush()
+        case !result.Context:
+            out.Write([]string{result.File, strconv.Itoa(result.Line),
+                strconv.Itoa(max(1, result.Column)), result.Text, result.Rule})
+        }
+        return out.Error()
+    }
+}
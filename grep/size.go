@@ -0,0 +1,44 @@
+package grep
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// ByteSize is a flag value for sizes like 512K, 64M or 5G.
+// The suffixes are powers of 1024, a plain number is bytes.
+type ByteSize int64
+
+// String returns the size in bytes
+func (size *ByteSize) String() string {
+    return strconv.FormatInt(int64(*size), 10)
+}
+
+// Set parses a size with an optional K, M, G or T suffix
+func (size *ByteSize) Set(value string) error {
+    s := strings.ToUpper(strings.TrimSpace(value))
+    s = strings.TrimSuffix(s, "B")
+    unit := int64(1)
+    if n := len(s); n > 0 {
+        switch s[n-1] {
+        case 'K':
+            unit = 1 << 10
+        case 'M':
+            unit = 1 << 20
+        case 'G':
+            unit = 1 << 30
+        case 'T':
+            unit = 1 << 40
+        }
+        if unit > 1 {
+            s = s[:n-1]
+        }
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || n < 0 {
+        return fmt.Errorf("invalid size: %s", value)
+    }
+    *size = ByteSize(n * unit)
+    return nil
+}
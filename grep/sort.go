@@ -0,0 +1,159 @@
+package grep
+
+import (
+    "context"
+    "io/fs"
+    "os"
+    "sort"
+)
+
+// The keys of --sort and --sortr
+var sortKeys = map[string]bool{"none": true, "path": true, "modified": true, "size": true}
+
+// sorting reports whether the output is sorted
+func (opts *Options) sorting() bool {
+    return opts.Sort != "none" || opts.SortReverse != "none"
+}
+
+// sortFiles sorts fnames by the --sort or --sortr key. The files are
+// still searched concurrently, the collector puts the results in order.
+// Files we can't stat sort as empty and old, the worker reports them.
+func sortFiles(fsys fs.FS, fnames []string, opts *Options) []string {
+    key, reverse := opts.Sort, false
+    if key == "none" {
+        key, reverse = opts.SortReverse, true
+    }
+
+    infos := make(map[string]os.FileInfo, len(fnames))
+    if key != "path" {
+        for _, fname := range fnames {
+            if info, err := statPath(fsys, fname); err == nil {
+                infos[fname] = info
+            }
+        }
+    }
+    less := func(a, b string) bool {
+        ia, ib := infos[a], infos[b]
+        switch {
+        case key == "path" || ia == nil && ib == nil:
+            return a < b
+        case ia == nil || ib == nil:
+            return ia == nil
+        case key == "modified" && !ia.ModTime().Equal(ib.ModTime()):
+            return ia.ModTime().Before(ib.ModTime())
+        case key == "size" && ia.Size() != ib.Size():
+            return ia.Size() < ib.Size()
+        }
+        return a < b
+    }
+
+    sorted := append([]string(nil), fnames...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        if reverse {
+            return less(sorted[j], sorted[i])
+        }
+        return less(sorted[i], sorted[j])
+    })
+    return sorted
+}
+
+// sortPaths collects all paths of fsys and sends them on sorted,
+// until the context is done
+func sortPaths(ctx context.Context, fsys fs.FS, paths <-chan string, opts *Options) <-chan string {
+    sorted := make(chan string, opts.workers())
+    go func() {
+        defer close(sorted)
+        var fnames []string
+        for path := range paths {
+            fnames = append(fnames, path)
+        }
+        start := opts.Stats.now()
+        fnames = sortFiles(fsys, fnames, opts)
+        opts.Stats.add(walkStage, start)
+        for _, fname := range fnames {
+            select {
+            case sorted <- fname:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return sorted
+}
+
+// reorder is the reorder buffer of the collector: it prints the results
+// in the order of the files' sequence numbers, holding back the results
+// of a file until all files before it are done
+type reorder struct {
+    head    int
+    pending map[int][]Result
+    done    map[int]bool
+    memory  *budget
+    print   func(Result)
+}
+
+// newReorder returns a reorder buffer printing through print
+func newReorder(memory *budget, print func(Result)) *reorder {
+    return &reorder{
+        pending: make(map[int][]Result),
+        done:    make(map[int]bool),
+        memory:  memory,
+        print:   print,
+    }
+}
+
+// add prints the result, if its file is at the head of the output,
+// otherwise it keeps it for later. Errors are printed right away.
+func (r *reorder) add(result Result) {
+    switch {
+    case result.Err != nil:
+        // Errors don't have to wait
+        r.print(result)
+    case result.seq == r.head && result.done:
+        r.advance()
+    case result.seq == r.head:
+        r.print(result)
+        r.memory.Release(int64(len(result.Text)))
+    case result.done:
+        r.done[result.seq] = true
+    default:
+        r.pending[result.seq] = append(r.pending[result.seq], result)
+        r.memory.Buffer(int64(len(result.Text)))
+    }
+}
+
+// advance moves the head past the done files, printing the results
+// kept for the files it passes
+func (r *reorder) advance() {
+    for {
+        r.head++
+        r.memory.Advance(r.head)
+        r.flush(r.head)
+        if !r.done[r.head] {
+            return
+        }
+        delete(r.done, r.head)
+    }
+}
+
+// flush prints the results kept for the file seq
+func (r *reorder) flush(seq int) {
+    for _, result := range r.pending[seq] {
+        r.print(result)
+        r.memory.Flush(int64(len(result.Text)))
+    }
+    delete(r.pending, seq)
+}
+
+// close prints whatever is left, in order. Files that were never
+// searched, because the search was cancelled, leave gaps.
+func (r *reorder) close() {
+    seqs := make([]int, 0, len(r.pending))
+    for seq := range r.pending {
+        seqs = append(seqs, seq)
+    }
+    sort.Ints(seqs)
+    for _, seq := range seqs {
+        r.flush(seq)
+    }
+}
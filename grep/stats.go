@@ -0,0 +1,74 @@
+package grep
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// The stages of a search that are timed
+const (
+    walkStage = iota
+    readStage
+    matchStage
+    printStage
+    cntStages
+)
+
+// StageNames are the names of the stages of a search, that Stats times
+var StageNames = [cntStages]string{"walk", "read", "match", "print"}
+
+// Stats collects the time spent in each stage of a search, summed
+// over all goroutines, and the number of files and bytes read.
+// All methods do nothing on a nil *Stats.
+type Stats struct {
+    stages [cntStages]atomic.Int64 // nanoseconds
+    files  atomic.Int64
+    bytes  atomic.Int64
+}
+
+// Files returns the number of files searched so far
+func (s *Stats) Files() int64 {
+    return s.files.Load()
+}
+
+// Bytes returns the number of bytes read so far
+func (s *Stats) Bytes() int64 {
+    return s.bytes.Load()
+}
+
+// Stage returns the time spent in the stage with the name StageNames[stage]
+func (s *Stats) Stage(stage int) time.Duration {
+    return time.Duration(s.stages[stage].Load())
+}
+
+// now returns the start time of a stage
+func (s *Stats) now() time.Time {
+    if s == nil {
+        return time.Time{}
+    }
+    return time.Now()
+}
+
+// add adds the time since start to the stage
+func (s *Stats) add(stage int, start time.Time) {
+    if s == nil {
+        return
+    }
+    s.stages[stage].Add(int64(time.Since(start)))
+}
+
+// file counts a searched file
+func (s *Stats) file() {
+    if s == nil {
+        return
+    }
+    s.files.Add(1)
+}
+
+// read counts n bytes read
+func (s *Stats) read(n int) {
+    if s == nil {
+        return
+    }
+    s.bytes.Add(int64(n))
+}
@@ -0,0 +1,27 @@
+package grep
+
+import (
+    "context"
+    "os"
+)
+
+// The name of the standard input in the results, like in grep
+const stdinName = "(standard input)"
+
+// IsStdin reports whether name stands for the standard input
+func IsStdin(name string) bool {
+    return name == "-"
+}
+
+// searchStdin reads the standard input line by line, as it
+// may be a stream that never ends, like the output of tail -f
+func (job Job) searchStdin(ctx context.Context, pat *Pattern, found chan<- Result) error {
+    job.fname = stdinName
+    job.opts.Stats.file()
+    count, err := job.scanBuffered(ctx, os.Stdin, pat, found, job.scanLines)
+    if err != nil || ctx.Err() != nil {
+        return err
+    }
+    job.sendCount(ctx, found, count)
+    return nil
+}
@@ -0,0 +1,97 @@
+package grep
+
+import (
+    "fmt"
+    "io"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// DirSummary rolls the match counts up by directory for --summary-by-dir:
+// every directory counts the matching lines and files below it
+type DirSummary struct {
+    opts *Options // the options of the search
+    dirs map[string]*dirCount
+}
+
+// dirCount holds the counts of a directory
+type dirCount struct {
+    lines int
+    files int
+}
+
+// NewDirSummary returns an empty summary of the search for pat,
+// showing --summary-depth levels of directories
+func NewDirSummary(pat *Pattern) *DirSummary {
+    return &DirSummary{opts: pat.opts, dirs: make(map[string]*dirCount)}
+}
+
+// Add is the sink of the search: it adds the count of a file to its
+// directory and all directories above it
+func (s *DirSummary) Add(result Result) error {
+    switch {
+    case result.Err != nil:
+        s.opts.logError(result.Err)
+        return nil
+    case result.Summary != nil:
+        s.opts.logUnreadable(result.Summary)
+        return nil
+    case result.Count == 0:
+        // Files without matches don't show up with --include-zero either
+        return nil
+    }
+    lines := result.Count
+    if s.opts.FilesOnly {
+        lines = 0
+    }
+    for dir := filepath.Dir(result.File); ; dir = filepath.Dir(dir) {
+        count := s.dirs[dir]
+        if count == nil {
+            count = new(dirCount)
+            s.dirs[dir] = count
+        }
+        count.lines += lines
+        count.files++
+        if parent := filepath.Dir(dir); parent == dir || dir == "." {
+            return nil
+        }
+    }
+}
+
+// Print writes the summary as a table sorted by directory, so that
+// subdirectories follow their parents like in a tree
+func (s *DirSummary) Print(w io.Writer) {
+    dirs := make([]string, 0, len(s.dirs))
+    for dir := range s.dirs {
+        if s.opts.SummaryDepth == 0 || dirDepth(dir) <= s.opts.SummaryDepth {
+            dirs = append(dirs, dir)
+        }
+    }
+    sort.Strings(dirs)
+
+    if s.opts.FilesOnly {
+        fmt.Fprintf(w, "%8s  %s\n", "files", "directory")
+    } else {
+        fmt.Fprintf(w, "%8s %8s  %s\n", "matches", "files", "directory")
+    }
+    for _, dir := range dirs {
+        count := s.dirs[dir]
+        if s.opts.FilesOnly {
+            fmt.Fprintf(w, "%8d  %s\n", count.files, s.opts.theme.colorFname(dir))
+        } else {
+            fmt.Fprintf(w, "%8d %8d  %s\n", count.lines, count.files, s.opts.theme.colorFname(dir))
+        }
+    }
+}
+
+// dirDepth returns the number of path elements of dir, "." has none
+func dirDepth(dir string) int {
+    depth := 0
+    for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+        if elem != "" && elem != "." {
+            depth++
+        }
+    }
+    return depth
+}
@@ -0,0 +1,207 @@
+package grep
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// translatePattern translates expr from the pattern syntax chosen on the
+// command line to RE2, the syntax of Go's regexp package.
+// The POSIX syntaxes also want leftmost-longest matching.
+func translatePattern(expr string, opts *Options) (string, bool, error) {
+    switch {
+    case opts.BasicRegexp:
+        rx, err := translateBRE(expr)
+        return rx, true, err
+    case opts.ExtendedRegexp:
+        rx, err := translateERE(expr)
+        return rx, true, err
+    case opts.Glob:
+        return translateGlob(expr), false, nil
+    case opts.FixedStrings:
+        return regexp.QuoteMeta(expr), false, nil
+    }
+    return expr, false, nil
+}
+
+// checkSyntax makes sure at most one pattern syntax was chosen
+func checkSyntax(opts *Options) error {
+    n := 0
+    for _, set := range []bool{opts.BasicRegexp, opts.ExtendedRegexp, opts.PerlRegexp, opts.Glob, opts.FixedStrings} {
+        if set {
+            n++
+        }
+    }
+    if n > 1 {
+        return errors.New("conflicting pattern syntaxes specified")
+    }
+    return nil
+}
+
+// translateBRE translates a POSIX basic regular expression, with the
+// GNU extensions \+, \?, \| and \< \>. In a BRE the characters ( ) { } |
+// + ? are literal unless escaped, * is literal at the start, ^ and $ only
+// anchor at the start and the end.
+func translateBRE(expr string) (string, error) {
+    var b strings.Builder
+    start := true // at the start of the expression or a group
+    for i := 0; i < len(expr); i++ {
+        c := expr[i]
+        switch {
+        case c == '\\' && i+1 < len(expr):
+            i++
+            switch e := expr[i]; {
+            case e == '(' || e == '|':
+                b.WriteByte(e)
+                start = true
+                continue
+            case e == ')' || e == '+' || e == '?':
+                b.WriteByte(e)
+            case e == '{':
+                end := strings.Index(expr[i:], `\}`)
+                if end < 0 {
+                    return "", errors.New(`unmatched \{`)
+                }
+                b.WriteString("{" + expr[i+1:i+end] + "}")
+                i += end + 1
+            case e >= '1' && e <= '9':
+                return "", errors.New("back-references are not supported")
+            case e == '<' || e == '>':
+                b.WriteString(`\b`)
+            default:
+                b.WriteByte('\\')
+                b.WriteByte(e)
+            }
+        case c == '[':
+            class, end, err := translateBracket(expr, i)
+            if err != nil {
+                return "", err
+            }
+            b.WriteString(class)
+            i = end
+        case c == '^' && start:
+            b.WriteByte('^')
+            continue
+        case c == '*' && start:
+            b.WriteString(`\*`)
+        case c == '$' && breEnd(expr, i+1):
+            b.WriteByte('$')
+        case strings.IndexByte("(){}|+?^$", c) >= 0:
+            b.WriteByte('\\')
+            b.WriteByte(c)
+        default:
+            b.WriteByte(c)
+        }
+        start = false
+    }
+    return b.String(), nil
+}
+
+// breEnd reports whether i is at the end of a BRE or a group in it,
+// where $ is an anchor
+func breEnd(expr string, i int) bool {
+    return i == len(expr) || strings.HasPrefix(expr[i:], `\)`) ||
+        strings.HasPrefix(expr[i:], `\|`)
+}
+
+// translateERE translates a POSIX extended regular expression, which is
+// RE2 already, except for back-references, the GNU word boundaries
+// \< \>, and the backslash being literal in bracket expressions
+func translateERE(expr string) (string, error) {
+    var b strings.Builder
+    for i := 0; i < len(expr); i++ {
+        c := expr[i]
+        switch {
+        case c == '\\' && i+1 < len(expr):
+            i++
+            switch e := expr[i]; {
+            case e >= '1' && e <= '9':
+                return "", errors.New("back-references are not supported")
+            case e == '<' || e == '>':
+                b.WriteString(`\b`)
+            default:
+                b.WriteByte('\\')
+                b.WriteByte(e)
+            }
+        case c == '[':
+            class, end, err := translateBracket(expr, i)
+            if err != nil {
+                return "", err
+            }
+            b.WriteString(class)
+            i = end
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return b.String(), nil
+}
+
+// translateBracket translates the POSIX bracket expression starting at i,
+// and returns it together with the index of its closing bracket.
+// A ] right after the opening [ or [^ is literal, and so are backslashes.
+// Character classes like [:alpha:] are kept, RE2 knows them.
+func translateBracket(expr string, i int) (string, int, error) {
+    var b strings.Builder
+    b.WriteByte('[')
+    j := i + 1
+    if j < len(expr) && expr[j] == '^' {
+        b.WriteByte('^')
+        j++
+    }
+    if j < len(expr) && expr[j] == ']' {
+        b.WriteString(`\]`)
+        j++
+    }
+    for ; j < len(expr); j++ {
+        switch c := expr[j]; {
+        case c == ']':
+            b.WriteByte(']')
+            return b.String(), j, nil
+        case c == '[' && j+1 < len(expr) && strings.IndexByte(":=.", expr[j+1]) >= 0:
+            end := strings.Index(expr[j+2:], string(expr[j+1])+"]")
+            if end < 0 {
+                return "", 0, fmt.Errorf("unterminated %q in bracket expression", expr[j:j+2])
+            }
+            b.WriteString(expr[j : j+2+end+2])
+            j += 2 + end + 1
+        case c == '\\':
+            b.WriteString(`\\`)
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return "", 0, errors.New("unmatched [")
+}
+
+// translateGlob translates a wildcard pattern: * matches any text, ?
+// a single character, [...] and [!...] a set of characters, the rest is
+// literal. Like a regexp, the glob may match anywhere in the line.
+func translateGlob(glob string) string {
+    var b strings.Builder
+    for i := 0; i < len(glob); i++ {
+        switch c := glob[i]; c {
+        case '*':
+            b.WriteString(".*")
+        case '?':
+            b.WriteByte('.')
+        case '[':
+            end := strings.IndexByte(glob[i+1:], ']')
+            if end < 0 {
+                b.WriteString(`\[`)
+                continue
+            }
+            class := strings.ReplaceAll(glob[i+1:i+1+end], `\`, `\\`)
+            if strings.HasPrefix(class, "!") {
+                class = "^" + class[1:]
+            }
+            b.WriteString("[" + class + "]")
+            i += end + 1
+        default:
+            b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+        }
+    }
+    return b.String()
+}
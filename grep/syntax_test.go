@@ -0,0 +1,67 @@
+package grep
+
+import (
+    "testing"
+)
+
+func TestPatternSyntax(t *testing.T) {
+    tests := []struct {
+        syntax, expr string
+        match        []string
+        noMatch      []string
+    }{
+        // In a BRE only the escaped operators are operators
+        {"-G", `a+b`, []string{"a+b"}, []string{"aab"}},
+        {"-G", `a\+b`, []string{"aab", "ab"}, []string{"a+b", "b"}},
+        {"-G", `\(ab\)\{2\}`, []string{"abab"}, []string{"ab", "(ab){2}"}},
+        {"-G", `(ab)`, []string{"(ab)"}, []string{"ab"}},
+        {"-G", `foo\|bar`, []string{"foo", "bar"}, []string{"fo|ba"}},
+        {"-G", `*a`, []string{"*a"}, []string{"a"}},
+        {"-G", `a^b$c`, []string{"a^b$c"}, []string{"abc"}},
+        {"-G", `\<is\>`, []string{"this is it"}, []string{"this"}},
+        {"-G", `[[:digit:]]\{3\}`, []string{"a123"}, []string{"a12"}},
+        {"-G", `[]a]`, []string{"]", "a"}, []string{"b"}},
+        // In an ERE they are operators without the backslash
+        {"-E", `a+b`, []string{"aab", "ab"}, []string{"a+b"}},
+        {"-E", `(ab){2}`, []string{"abab"}, []string{"ab"}},
+        {"-E", `foo|bar`, []string{"foo", "bar"}, []string{"fo"}},
+        {"-E", `a\+b`, []string{"a+b"}, []string{"aab"}},
+        {"-E", `[^[:space:]]x`, []string{"ax"}, []string{" x", "x"}},
+        // RE2 stays as it is
+        {"-P", `\d+\s\w`, []string{"12 a"}, []string{"12a"}},
+        {"-P", `(?i)foo`, []string{"FOO"}, []string{"fo"}},
+        // Wildcards match anywhere in the line, like a regexp
+        {"--glob-pattern", `*.go`, []string{"main.go", "main.go.txt"}, []string{"main_go"}},
+        {"--glob-pattern", `a?c`, []string{"abc", "xabc"}, []string{"ac", "abbc"}},
+        {"--glob-pattern", `[!ab]x`, []string{"cx"}, []string{"ax", "bx"}},
+        {"--glob-pattern", `*(1)*`, []string{"f(1)"}, []string{"f1"}},
+        {"-F", `a.b*`, []string{"xa.b*"}, []string{"axbb"}},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.syntax, test.expr)
+        for _, line := range test.match {
+            if !pat.match([]byte(line)) {
+                t.Errorf("%s %q doesn't match %q", test.syntax, test.expr, line)
+            }
+        }
+        for _, line := range test.noMatch {
+            if pat.match([]byte(line)) {
+                t.Errorf("%s %q matches %q", test.syntax, test.expr, line)
+            }
+        }
+    }
+}
+
+func TestPatternSyntaxErrors(t *testing.T) {
+    opts := DefaultOptions()
+    opts.BasicRegexp = true
+    for _, expr := range []string{`\(a`, `a\{2`, `[a`} {
+        if _, err := Compile(opts, expr); err == nil {
+            t.Errorf("-G %q: got no error", expr)
+        }
+    }
+    opts.ExtendedRegexp = true
+    if err := opts.Validate(); err == nil {
+        t.Errorf("-G -E: got no error")
+    }
+}
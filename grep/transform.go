@@ -0,0 +1,205 @@
+package grep
+
+import (
+    "regexp/syntax"
+    "sort"
+    "unicode"
+    "unicode/utf8"
+)
+
+// The full case foldings, that turn one character into several, which
+// a (?i) regexp doesn't know about
+var fullFolds = map[rune]string{
+    'ß': "ss", 'ẞ': "ss", 'ŉ': "ʼn", 'İ': "i̇",
+    'ﬀ': "ff", 'ﬁ': "fi", 'ﬂ': "fl", 'ﬃ': "ffi", 'ﬄ': "ffl", 'ﬅ': "st", 'ﬆ': "st",
+}
+
+// accentBases maps the lower case Latin letters with diacritics to
+// their base letters for --fold-accents. Some of them, like ø and ł,
+// aren't decomposed by Unicode, but are taken for the base letter by
+// most readers.
+var accentBases = map[rune]rune{}
+
+func init() {
+    for base, letters := range map[rune]string{
+        'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđð", 'e': "èéêëēĕėęě",
+        'g': "ĝğġģ", 'h': "ĥħ", 'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ",
+        'l': "ĺļľŀł", 'n': "ñńņň", 'o': "òóôõöøōŏő", 'r': "ŕŗř",
+        's': "śŝşš", 't': "ţťŧ", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ",
+        'z': "źżž",
+    } {
+        for _, letter := range letters {
+            accentBases[letter] = base
+        }
+    }
+}
+
+// folding reports whether the lines are transformed for --fold or
+// --fold-accents before they are matched
+func (opts *Options) folding() bool {
+    return opts.Fold || opts.FoldAccents
+}
+
+// foldRune appends r folded to b: in lower case, the lower case of
+// the upper case, so that e.g. final sigma is sigma, with the full
+// foldings and, with --fold-accents, without diacritics
+func foldRune(b []byte, r rune, accents bool) []byte {
+    if s, ok := fullFolds[r]; ok {
+        for _, r := range s {
+            b = appendBase(b, r, accents)
+        }
+        return b
+    }
+    return appendBase(b, unicode.ToLower(unicode.ToUpper(r)), accents)
+}
+
+// appendBase appends the folded r to b, with accents, for
+// --fold-accents, its base letter
+func appendBase(b []byte, r rune, accents bool) []byte {
+    if accents {
+        if unicode.In(r, unicode.Mn) {
+            // A combining mark of a decomposed letter
+            return b
+        }
+        if base, ok := accentBases[r]; ok {
+            r = base
+        }
+    }
+    return utf8.AppendRune(b, r)
+}
+
+// foldLine returns the line folded like the pattern. A line in ASCII
+// lower case is returned as it is.
+func foldLine(line []byte, accents bool) []byte {
+    plain := true
+    for _, c := range line {
+        if c >= utf8.RuneSelf || 'A' <= c && c <= 'Z' {
+            plain = false
+            break
+        }
+    }
+    if plain {
+        return line
+    }
+    folded := make([]byte, 0, len(line))
+    for len(line) > 0 {
+        r, size := utf8.DecodeRune(line)
+        if r == utf8.RuneError && size == 1 {
+            // Bytes that aren't UTF-8 stay as they are
+            folded = append(folded, line[0])
+        } else {
+            folded = foldRune(folded, r, accents)
+        }
+        line = line[size:]
+    }
+    return folded
+}
+
+// foldMapped returns line folded like foldLine, with the offset in line
+// of the character each byte of the folded line comes from, and the
+// length of line at the end
+func foldMapped(line string, accents bool) (string, []int) {
+    folded := make([]byte, 0, len(line))
+    offsets := make([]int, 0, len(line)+1)
+    for pos := 0; pos < len(line); {
+        r, size := utf8.DecodeRuneInString(line[pos:])
+        n := len(folded)
+        if r == utf8.RuneError && size == 1 {
+            folded = append(folded, line[pos])
+        } else {
+            folded = foldRune(folded, r, accents)
+        }
+        for ; n < len(folded); n++ {
+            offsets = append(offsets, pos)
+        }
+        pos += size
+    }
+    return string(folded), append(offsets, len(line))
+}
+
+// unfoldSpan maps the span of a match in a folded line back to the line
+// with the offsets of foldMapped. A span that begins or ends within the
+// folding of a character, like the first s of the ss of ß, takes in the
+// whole character.
+func unfoldSpan(offsets []int, start, end int) (int, int) {
+    from := offsets[start]
+    for end < len(offsets)-1 && end > start && offsets[end] == offsets[end-1] {
+        end++
+    }
+    return from, offsets[end]
+}
+
+// foldString returns s folded like the lines
+func foldString(s string, accents bool) string {
+    var b []byte
+    for _, r := range s {
+        b = foldRune(b, r, accents)
+    }
+    return string(b)
+}
+
+// Character classes with more characters than this aren't folded, they
+// are mostly negated classes, which already hold the folded characters
+const maxFoldedClass = 1024
+
+// foldPattern folds the literals of the RE2 expression expr like the
+// lines, so the folded pattern matches the folded lines. Character
+// classes get the folded forms of their characters added.
+func foldPattern(expr string, accents bool) (string, error) {
+    re, err := syntax.Parse(expr, syntax.Perl)
+    if err != nil {
+        return "", err
+    }
+    foldSyntax(re, accents)
+    return re.String(), nil
+}
+
+// foldSyntax folds the literals and character classes below re
+func foldSyntax(re *syntax.Regexp, accents bool) {
+    switch re.Op {
+    case syntax.OpLiteral:
+        re.Rune = []rune(foldString(string(re.Rune), accents))
+        re.Flags &^= syntax.FoldCase
+    case syntax.OpCharClass:
+        size := 0
+        for i := 0; i+1 < len(re.Rune); i += 2 {
+            size += int(re.Rune[i+1]-re.Rune[i]) + 1
+        }
+        if size > maxFoldedClass {
+            break
+        }
+        var added []rune
+        for i := 0; i+1 < len(re.Rune); i += 2 {
+            for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+                if folded := []rune(foldString(string(r), accents)); len(folded) == 1 {
+                    added = append(added, folded[0], folded[0])
+                }
+            }
+        }
+        re.Rune = append(re.Rune, added...)
+        cleanClass(re)
+    }
+    for _, sub := range re.Sub {
+        foldSyntax(sub, accents)
+    }
+}
+
+// cleanClass sorts and merges the ranges of a character class, as the
+// syntax package expects them
+func cleanClass(re *syntax.Regexp) {
+    type span struct{ lo, hi rune }
+    var spans []span
+    for i := 0; i+1 < len(re.Rune); i += 2 {
+        spans = append(spans, span{re.Rune[i], re.Rune[i+1]})
+    }
+    sort.Slice(spans, func(i, j int) bool { return spans[i].lo < spans[j].lo })
+    var merged []rune
+    for _, s := range spans {
+        if n := len(merged); n > 0 && s.lo <= merged[n-1]+1 {
+            merged[n-1] = max(merged[n-1], s.hi)
+            continue
+        }
+        merged = append(merged, s.lo, s.hi)
+    }
+    re.Rune = merged
+}
@@ -0,0 +1,112 @@
+package grep
+
+import (
+    "io"
+    "testing"
+)
+
+func TestFoldLine(t *testing.T) {
+    tests := []struct {
+        flag, line, want string
+    }{
+        {"--fold", "abc", "abc"},
+        {"--fold", "Straße", "strasse"},
+        {"--fold", "ΣΑΣ ς", "σασ σ"},
+        {"--fold", "ﬁnd", "find"},
+        {"--fold", "Café", "café"},
+        {"--fold-accents", "Café", "cafe"},
+        {"--fold-accents", "Café", "cafe"},
+        {"--fold-accents", "ØRSTED Łódź", "orsted lodz"},
+        // Bytes that aren't UTF-8 stay as they are
+        {"--fold", "A\xffB", "a\xffb"},
+    }
+    for _, test := range tests {
+        accents := test.flag == "--fold-accents"
+        if got := string(foldLine([]byte(test.line), accents)); got != test.want {
+            t.Errorf("%s %q: got %q, want %q", test.flag, test.line, got, test.want)
+        }
+        if got, _ := foldMapped(test.line, accents); got != test.want {
+            t.Errorf("%s %q mapped: got %q, want %q", test.flag, test.line, got, test.want)
+        }
+    }
+}
+
+func TestFoldPattern(t *testing.T) {
+    tests := []struct {
+        flag, expr string
+        match      []string
+        noMatch    []string
+    }{
+        {"--fold", "STRASSE", []string{"Straße", "strasse", "STRAẞE"}, []string{"strase"}},
+        {"--fold", "straße", []string{"STRASSE", "Strasse"}, nil},
+        {"--fold", "^[Ä]x$", []string{"äx", "Äx"}, []string{"ax"}},
+        {"--fold", "cafe", []string{"CAFE"}, []string{"café"}},
+        {"--fold-accents", "cafe", []string{"Café", "CAFÉ"}, []string{"caf"}},
+        {"--fold-accents", "^[a-z]+$", []string{"Ça", "Øre"}, []string{"a1"}},
+        {"--fold-accents", "CAFÉ", []string{"cafe"}, nil},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.flag, test.expr)
+        for _, line := range test.match {
+            if !pat.match([]byte(line)) {
+                t.Errorf("%s %q doesn't match %q", test.flag, test.expr, line)
+            }
+        }
+        for _, line := range test.noMatch {
+            if pat.match([]byte(line)) {
+                t.Errorf("%s %q matches %q", test.flag, test.expr, line)
+            }
+        }
+    }
+}
+
+// The matches in the folded lines are told with the offsets in the
+// printed lines
+func TestFoldSpans(t *testing.T) {
+    tests := []struct {
+        flag, expr, line string
+        match            string
+        column           int
+    }{
+        {"--fold", "ss", "Straße", "ß", 5},
+        {"--fold", "as", "Straße", "aß", 4},
+        {"--fold", "se", "STRAẞE", "ẞE", 5},
+        {"--fold", "fi", "the ﬁrst", "ﬁ", 5},
+        {"--fold", "σ", "ΑΣ", "Σ", 3},
+        {"--fold-accents", "cafe", "Le Café", "Café", 4},
+        {"--fold-accents", "cafe", "Le Café!", "Café", 4},
+        {"--fold-accents", "e!", "Le Café!", "é!", 7},
+    }
+    for _, test := range tests {
+        pat := setOptions(t, test.flag, test.expr)
+        locs := pat.findAll(test.line, -1)
+        if len(locs) != 1 {
+            t.Errorf("%s %q in %q: got %d matches, want 1", test.flag, test.expr, test.line, len(locs))
+            continue
+        }
+        if got := test.line[locs[0][0]:locs[0][1]]; got != test.match {
+            t.Errorf("%s %q in %q: got %q, want %q", test.flag, test.expr, test.line, got, test.match)
+        }
+        p := newPrinter(io.Discard, pat)
+        if got := p.column(Result{Text: test.line}); got != test.column {
+            t.Errorf("%s %q in %q: got column %d, want %d", test.flag, test.expr, test.line, got, test.column)
+        }
+    }
+}
+
+func TestFoldGroups(t *testing.T) {
+    pat := setOptions(t, "--fold-accents", "(?P<word>cafe) (?P<end>x)?")
+    line := "au CAFÉ noir"
+    groups := captureGroups(pat, line)
+    if len(groups) != 1 {
+        t.Fatalf("got groups %+v, want one", groups)
+    }
+    if g := groups[0]; g.Name != "word" || g.Text != "CAFÉ" || g.Start != 3 || g.End != 8 {
+        t.Errorf("got group %+v, want word CAFÉ at 3-8", g)
+    }
+
+    pat.opts.theme = &colorTheme{match: "1"}
+    if got, want := highlight(line, pat), "au "+paint("1", "CAFÉ ")+"noir"; got != want {
+        t.Errorf("got highlight %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,41 @@
+package grep
+
+import (
+    "sort"
+    "sync"
+)
+
+// matchSet is the set of distinct matches for --unique, counting their
+// occurrences. The workers share it, so a match that was seen before
+// never even reaches the collector.
+type matchSet struct {
+    mu     sync.Mutex
+    counts map[string]int
+}
+
+// newMatchSet returns an empty set
+func newMatchSet() *matchSet {
+    return &matchSet{counts: make(map[string]int)}
+}
+
+// add counts an occurrence of match. It reports whether it's the first.
+func (s *matchSet) add(match string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.counts[match]++
+    return s.counts[match] == 1
+}
+
+// each calls fn for the matches in sorted order, with their counts
+func (s *matchSet) each(fn func(match string, count int)) {
+    s.mu.Lock()
+    matches := make([]string, 0, len(s.counts))
+    for match := range s.counts {
+        matches = append(matches, match)
+    }
+    s.mu.Unlock()
+    sort.Strings(matches)
+    for _, match := range matches {
+        fn(match, s.counts[match])
+    }
+}
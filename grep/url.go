@@ -0,0 +1,105 @@
+package grep
+
+import (
+    "context"
+    "errors"
+    "io"
+    "io/fs"
+    "net/http"
+    "strings"
+)
+
+// The client fetching URLs. The timeouts come from the context of the job.
+var httpClient = &http.Client{}
+
+// IsURL reports whether name is an http or https URL instead of a file
+func IsURL(name string) bool {
+    return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// searchURL fetches the URL of the job and streams the response body
+// through the line or the chunk scanner, like a file that can't be mapped
+func (job Job) searchURL(ctx context.Context, pat *Pattern, found chan<- Result) error {
+    // A connection needs a file descriptor too
+    if !acquireOpen(ctx) {
+        return nil
+    }
+    defer releaseOpen()
+
+    body, err := openURL(ctx, job.fname, job.opts.MaxURLSize)
+    if err != nil {
+        return err
+    }
+    defer body.Close()
+
+    job.opts.Stats.file()
+    count, err := job.scanStream(ctx, body, pat, found)
+    if err != nil || ctx.Err() != nil {
+        return err
+    }
+    job.sendCount(ctx, found, count)
+    return nil
+}
+
+// scanStream searches a stream that can't be mapped, like a response
+// body, with the line or the chunk scanner
+func (job Job) scanStream(ctx context.Context, r io.Reader, pat *Pattern,
+    found chan<- Result) (int, error) {
+    if (job.opts.CountOnly || job.opts.FilesOnly) && pat.chunkRx != nil && job.opts.Lines.all() &&
+        strategies[job.opts.Strategy] != bufioStrategy {
+        return job.scanBuffered(ctx, r, pat, found, job.scanChunks)
+    }
+    return job.scanBuffered(ctx, r, pat, found, job.scanLines)
+}
+
+// openURL sends a GET request for url and returns the body of a
+// successful response, limited to --max-url-size
+func openURL(ctx context.Context, url string, limit ByteSize) (io.ReadCloser, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, &fs.PathError{Op: "get", Path: url, Err: err}
+    }
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return nil, &fs.PathError{Op: "get", Path: url, Err: errors.Unwrap(err)}
+    }
+    if resp.StatusCode != http.StatusOK {
+        resp.Body.Close()
+        return nil, &fs.PathError{Op: "get", Path: url, Err: errors.New(resp.Status)}
+    }
+    if limit > 0 && resp.ContentLength > int64(limit) {
+        resp.Body.Close()
+        return nil, &fs.PathError{Op: "get", Path: url, Err: errTooLarge}
+    }
+    if limit == 0 {
+        return resp.Body, nil
+    }
+    return &limitedBody{ReadCloser: resp.Body, left: int64(limit)}, nil
+}
+
+// The error for responses over the size limit
+var errTooLarge = errors.New("response is larger than --max-url-size")
+
+// limitedBody fails reading beyond the size limit, unlike io.LimitReader,
+// which would quietly cut the body short
+type limitedBody struct {
+    io.ReadCloser
+    left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+    if b.left <= 0 {
+        // Only fail, if there is more to come
+        var one [1]byte
+        if n, _ := b.ReadCloser.Read(one[:]); n == 0 {
+            return 0, io.EOF
+        }
+        return 0, errTooLarge
+    }
+    if int64(len(p)) > b.left {
+        p = p[:b.left]
+    }
+    n, err := b.ReadCloser.Read(p)
+    b.left -= int64(n)
+    return n, err
+}
@@ -0,0 +1,204 @@
+package grep
+
+import (
+    "context"
+    "io/fs"
+    "os"
+    "sync"
+)
+
+// Walk sends the files on disk to search with opts on the returned
+// channel, like a search walks them: the roots, and with -r or -R the
+// files below them. The errors of the walk go to report.
+func Walk(ctx context.Context, roots []string, opts Options, report func(error)) <-chan string {
+    return walk(ctx, nil, roots, &opts, report)
+}
+
+// walk sends the files of fsys to search on the returned channel: the
+// command line files, and with -r or -R the files in the directories
+// below the command line directories. The directories are read
+// concurrently by a pool of walkers, which pass their errors to report.
+// The channel is closed when all is done, or the context is.
+func walk(ctx context.Context, fsys fs.FS, roots []string, opts *Options, report func(error)) <-chan string {
+    paths := make(chan string, opts.workers())
+    w := &walker{ctx: ctx, fsys: fsys, opts: opts, paths: paths, report: report, visited: make(map[fileKey]bool)}
+    w.cond = sync.NewCond(&w.mu)
+
+    go func() {
+        defer close(paths)
+        for _, root := range roots {
+            info, err := statPath(fsys, root)
+            switch {
+            case (opts.Recursive || opts.Follow) && err == nil && info.IsDir():
+                w.enter(root)
+                w.push(dirJob{root, nil, 0})
+            case err == nil && !opts.searchable(info.Mode()):
+                continue
+            case !w.send(root):
+                // Let the worker report errors about the file
+                return
+            }
+        }
+
+        var wg sync.WaitGroup
+        for i := 0; i < opts.workers(); i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                w.run()
+            }()
+        }
+        wg.Wait()
+    }()
+    return paths
+}
+
+// A dirJob is a directory to read, with the ignore rules that apply,
+// and how deep below a command line directory it is
+type dirJob struct {
+    path   string
+    ignore *ignoreLayer
+    depth  int
+}
+
+// walker holds the directories still to read, and the directories
+// entered so far, so that following symbolic links can't loop
+type walker struct {
+    ctx     context.Context
+    fsys    fs.FS // the file system walked, nil for the one of the system
+    opts    *Options
+    paths   chan<- string
+    report  func(error)
+    mu      sync.Mutex
+    cond    *sync.Cond
+    queue   []dirJob
+    pending int // directories queued or being read
+    visited map[fileKey]bool
+}
+
+// push queues a directory
+func (w *walker) push(dir dirJob) {
+    w.mu.Lock()
+    w.queue = append(w.queue, dir)
+    w.pending++
+    w.mu.Unlock()
+    w.cond.Signal()
+}
+
+// run reads directories until there are none left.
+// The queue is a stack, which keeps it short on wide trees.
+func (w *walker) run() {
+    for {
+        w.mu.Lock()
+        for len(w.queue) == 0 && w.pending > 0 {
+            w.cond.Wait()
+        }
+        if w.pending == 0 {
+            w.mu.Unlock()
+            return
+        }
+        dir := w.queue[len(w.queue)-1]
+        w.queue = w.queue[:len(w.queue)-1]
+        w.mu.Unlock()
+
+        if w.ctx.Err() == nil {
+            w.read(dir)
+        }
+
+        w.mu.Lock()
+        w.pending--
+        if w.pending == 0 {
+            w.cond.Broadcast()
+        }
+        w.mu.Unlock()
+    }
+}
+
+// read sends the files of a directory and queues its subdirectories,
+// skipping what the ignore rules exclude and what is deeper than
+// --max-depth. The type of an entry comes with the directory, so files
+// are only stat-ed when they are symbolic links to follow.
+func (w *walker) read(dir dirJob) {
+    start := w.opts.Stats.now()
+    entries, err := readDir(w.ctx, w.fsys, dir.path)
+    w.opts.Stats.add(walkStage, start)
+    if err != nil {
+        // We still get the entries read before the error, the
+        // siblings are read anyway
+        w.report(dirError{err})
+    }
+
+    ignore := dir.ignore
+    if !w.opts.NoIgnore {
+        ignore = ignore.load(w.fsys, dir.path, entries)
+    }
+
+    // The subdirectories are only entered above the maximum depth
+    depth := dir.depth + 1
+    descend := w.opts.MaxDepth <= 0 || depth < w.opts.MaxDepth
+
+    for _, entry := range entries {
+        if w.ctx.Err() != nil {
+            // Nobody waits for the rest of the tree
+            return
+        }
+        path := joinPath(w.fsys, dir.path, entry.Name())
+        mode := entry.Type()
+        if mode&os.ModeSymlink != 0 {
+            if !w.opts.Follow || w.fsys != nil {
+                continue
+            }
+            info, err := os.Stat(OSPath(path))
+            if err != nil {
+                w.report(userPath(err, path))
+                continue
+            }
+            mode = info.Mode().Type()
+        }
+
+        isDir := mode.IsDir()
+        if isDir && !descend || !isDir && !w.opts.searchable(mode) {
+            continue
+        }
+        if !w.opts.NoIgnore && (isDir && entry.Name() == ".git" || ignore.ignored(path, isDir)) {
+            continue
+        }
+        if isDir {
+            if w.enter(path) {
+                w.push(dirJob{path, ignore, depth})
+            }
+        } else if !w.send(path) {
+            return
+        }
+    }
+}
+
+// enter marks a directory as entered. It returns false, if it was
+// entered before, by following a symbolic link.
+func (w *walker) enter(path string) bool {
+    if !w.opts.Follow {
+        // Without symbolic links there are no loops
+        return true
+    }
+    key, ok := keyOf(w.fsys, path)
+    if !ok {
+        return true
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.visited[key] {
+        return false
+    }
+    w.visited[key] = true
+    return true
+}
+
+// send hands on a file to search. It returns false, if the context is done.
+func (w *walker) send(path string) bool {
+    select {
+    case w.paths <- path:
+        return true
+    case <-w.ctx.Done():
+        return false
+    }
+}
@@ -0,0 +1,125 @@
+package grep
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/fs"
+    "testing"
+    "testing/fstest"
+)
+
+// closed releases the slow directory of a slowDirFS right away
+var closed = func() chan struct{} {
+    c := make(chan struct{})
+    close(c)
+    return c
+}()
+
+// slowDirFS fails to read the directory slow, once release is closed.
+// reading is closed, when it starts to, and failed, when it failed.
+type slowDirFS struct {
+    fstest.MapFS
+    reading chan struct{}
+    release <-chan struct{}
+    failed  chan struct{}
+}
+
+func newSlowDirFS(files fstest.MapFS, release <-chan struct{}) slowDirFS {
+    return slowDirFS{files, make(chan struct{}), release, make(chan struct{})}
+}
+
+func (f slowDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+    if name == "slow" {
+        close(f.reading)
+        <-f.release
+        defer close(f.failed)
+        return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("slow failure")}
+    }
+    return f.MapFS.ReadDir(name)
+}
+
+// A walker that reports an error after the sink stopped the search
+// must not send on the closed results, and the error is dropped
+func TestWalkErrorAfterStop(t *testing.T) {
+    pat := setOptions(t, "-r", "foo")
+    // Another walker reads slow, while the first one waits
+    pat.opts.Workers = 4
+    // The files keep the walker of the top directory waiting for the
+    // workers, and the workers for the sink
+    files := fstest.MapFS{"slow/a.txt": {Data: []byte("foo\n")}}
+    for i := 0; i < 100; i++ {
+        files[fmt.Sprintf("x%03d.txt", i)] = &fstest.MapFile{Data: []byte("foo\n")}
+    }
+    // The walker of slow gets to its error only once the search is
+    // cancelled
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    fsys := newSlowDirFS(files, ctx.Done())
+    stop := errors.New("stop")
+    calls := 0
+    err := SearchFS(ctx, fsys, pat, []string{"."}, func(result Result) error {
+        calls++
+        if calls == 1 {
+            <-fsys.reading
+            cancel()
+        }
+        return stop
+    })
+    if !errors.Is(err, stop) {
+        t.Fatalf("got error %v, want %v", err, stop)
+    }
+    // SearchFS returns after the walkers, so slow failed by now
+    select {
+    case <-fsys.failed:
+    default:
+        t.Fatal("the walker of slow is still reading")
+    }
+    if calls != 1 {
+        t.Errorf("the sink got %d results after it stopped the search", calls-1)
+    }
+}
+
+// The walkers are done, and the paths closed, once the walker that
+// is reading when the context is cancelled gets to its error
+func TestWalkStop(t *testing.T) {
+    pat := setOptions(t, "-r", "foo")
+    pat.opts.Workers = 4
+    release := make(chan struct{})
+    fsys := newSlowDirFS(fstest.MapFS{
+        "a.txt":      {Data: []byte("foo\n")},
+        "slow/b.txt": {Data: []byte("foo\n")},
+    }, release)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    reported := make(chan error, 10)
+    paths := walk(ctx, fsys, []string{"."}, pat.opts, func(err error) { reported <- err })
+    <-fsys.reading
+    cancel()
+    close(release)
+    for range paths {
+    }
+    // With the paths closed, no walker is left to report
+    if len(reported) != 1 {
+        t.Errorf("got %d errors, want the error of slow once", len(reported))
+    }
+}
+
+// The errors of the walk reach the sink like those of the files
+func TestWalkError(t *testing.T) {
+    pat := setOptions(t, "-r", "foo")
+    fsys := newSlowDirFS(fstest.MapFS{
+        "a.txt":      {Data: []byte("foo\n")},
+        "slow/b.txt": {Data: []byte("foo\n")},
+    }, closed)
+    results, err := searchResults(t, fsys, pat, ".")
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := matchedLines(results)
+    want := []string{"a.txt:foo", "slow: slow failure"}
+    if !equalLines(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,149 @@
+package grep
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// errStuck is the cause of a job abandoned by the watchdog
+var errStuck = errors.New("stuck")
+
+// watchdog looks after the jobs of the workers for --watchdog: a job
+// on the same file for longer than the threshold is logged with the
+// offset it got to, again every threshold. With --watchdog-abandon a
+// job that waited for the threshold on opening or reading its file is
+// given up, so that e.g. a device or a stalled network mount doesn't
+// hold up the whole run. A job waiting for the memory budget or for
+// the results to be printed isn't stuck. A nil *watchdog looks after
+// nothing.
+type watchdog struct {
+    threshold time.Duration
+    abandon   bool
+    mu        sync.Mutex
+    jobs      map[*jobProgress]bool
+}
+
+// jobProgress is what the watchdog knows about a job
+type jobProgress struct {
+    fname    string
+    start    time.Time
+    offset   atomic.Int64 // the bytes read so far
+    waiting  atomic.Int64 // since when the job waits on its file, in Unix nanoseconds, or 0
+    reported time.Duration
+    cancel   context.CancelCauseFunc
+}
+
+// newWatchdog returns a watchdog for jobs longer than threshold, which
+// looks after them until the context is done, or nil for threshold = 0
+func newWatchdog(ctx context.Context, threshold time.Duration, abandon bool) *watchdog {
+    if threshold <= 0 {
+        return nil
+    }
+    w := &watchdog{threshold: threshold, abandon: abandon, jobs: make(map[*jobProgress]bool)}
+    go func() {
+        // Checking four times per threshold, a job is reported at most
+        // a quarter of it late
+        ticker := time.NewTicker(max(threshold/4, time.Millisecond))
+        defer ticker.Stop()
+        for {
+            select {
+            case now := <-ticker.C:
+                w.check(now)
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return w
+}
+
+// begin starts looking after the job for fname, which cancel abandons
+func (w *watchdog) begin(fname string, cancel context.CancelCauseFunc) *jobProgress {
+    if w == nil {
+        return nil
+    }
+    p := &jobProgress{fname: fname, start: time.Now(), cancel: cancel}
+    w.mu.Lock()
+    w.jobs[p] = true
+    w.mu.Unlock()
+    return p
+}
+
+// end stops looking after the job
+func (w *watchdog) end(p *jobProgress) {
+    if w == nil {
+        return
+    }
+    w.mu.Lock()
+    delete(w.jobs, p)
+    w.mu.Unlock()
+}
+
+// check abandons the jobs that waited on their file for the threshold,
+// and reports the ones that took another threshold
+func (w *watchdog) check(now time.Time) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    for p := range w.jobs {
+        offset := p.offset.Load()
+        if since := p.waiting.Load(); w.abandon && since != 0 && now.Sub(time.Unix(0, since)) >= w.threshold {
+            log.Printf("warning: %s: stuck at byte %d for %s, giving up on it\n",
+                p.fname, offset, w.threshold)
+            p.cancel(errStuck)
+            delete(w.jobs, p)
+            continue
+        }
+        elapsed := now.Sub(p.start)
+        if elapsed < p.reported+w.threshold {
+            continue
+        }
+        log.Printf("warning: %s: still searched after %s, at byte %d\n",
+            p.fname, elapsed.Truncate(w.threshold), offset)
+        p.reported = elapsed
+    }
+}
+
+// wait marks the job as waiting on its file, until the returned
+// function is called
+func (p *jobProgress) wait() func() {
+    if p == nil {
+        return func() {}
+    }
+    p.waiting.Store(time.Now().UnixNano())
+    return func() { p.waiting.Store(0) }
+}
+
+// reader returns r counting the bytes read from it, or r itself
+// without a watchdog
+func (p *jobProgress) reader(r io.Reader) io.Reader {
+    if p == nil {
+        return r
+    }
+    return &progressReader{r: r, p: p}
+}
+
+// progressReader counts the bytes read for the watchdog
+type progressReader struct {
+    r io.Reader
+    p *jobProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+    done := r.p.wait()
+    n, err := r.r.Read(b)
+    done()
+    r.p.offset.Add(int64(n))
+    return n, err
+}
+
+// stuckError is the error of a file given up by the watchdog
+func stuckError(fname string, p *jobProgress) *FileError {
+    return &FileError{File: fname, Op: "search", Message: "stuck, abandoned",
+        Text: fmt.Sprintf("%s: search stuck at byte %d, abandoned", fname, p.offset.Load())}
+}
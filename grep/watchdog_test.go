@@ -0,0 +1,33 @@
+package grep
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// Only a job waiting on its file is abandoned, not one waiting for the
+// sink or the memory budget
+func TestWatchdogAbandon(t *testing.T) {
+    w := &watchdog{threshold: time.Second, abandon: true, jobs: make(map[*jobProgress]bool)}
+    ctx, cancel := context.WithCancelCause(context.Background())
+    defer cancel(nil)
+    p := w.begin("slow", cancel)
+
+    // Held up by the printing of its results for a while
+    w.check(p.start.Add(3 * time.Second))
+    if ctx.Err() != nil {
+        t.Fatal("abandoned while it didn't wait on the file")
+    }
+
+    done := p.wait()
+    w.check(time.Now().Add(w.threshold / 2))
+    if ctx.Err() != nil {
+        t.Fatal("abandoned before the threshold")
+    }
+    w.check(time.Now().Add(w.threshold))
+    if context.Cause(ctx) != errStuck {
+        t.Fatalf("got cause %v, want %v", context.Cause(ctx), errStuck)
+    }
+    done()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "log"
+    "os"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// imageMain searches the files in the layers of a container image:
+// "cgrep image [options] <regexp> <tarball>". The tarball is written by
+// "docker save" or is an OCI image layout. The matches are reported as
+// layer digest, path in the layer and line.
+func imageMain(args []string) {
+    parseOptions(args)
+    if len(roots()) != 1 || grep.IsStdin(roots()[0]) {
+        log.Fatalf("image: expected one image tarball\n")
+    }
+    stopProfiles := mustProfile()
+    defer stopProfiles()
+
+    ctx := context.Background()
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
+    }
+
+    // The path in the layer is what the matches are about
+    opts.Filenames = !*noFilename
+
+    pat := mustCompile()
+    out := mustOutput()
+    sink, searched := keepSummary(grep.WriterSink(output, pat))
+    err := grep.SearchImage(ctx, pat, roots()[0], sink)
+    if err != nil {
+        log.Printf("error: %s\n", err)
+    }
+    err = commitOutput(out, err)
+    if status := exitStatus(ctx, err, searched()); status != 0 {
+        stopProfiles()
+        os.Exit(status)
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log"
+    "math/rand/v2"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+)
+
+// outputFile writes the results for --output to a temporary file next
+// to the file, which takes its name only once the search is done. So
+// the file is either complete or not there, even if cgrep is killed.
+type outputFile struct {
+    name string
+    tmp  *os.File
+    buf  *bufio.Writer
+    zw   *gzip.Writer // compresses a name ending in .gz, otherwise nil
+    w    io.Writer
+    err  error // the first failed write
+}
+
+// mustOutput points output to the --output file, if there is one
+func mustOutput() *outputFile {
+    if *outputName == "" {
+        return nil
+    }
+    out, err := createOutput(*outputName)
+    if err != nil {
+        log.Fatalf("%s\n", err)
+    }
+    output = out
+    return out
+}
+
+// rejectOutput exits on --output in the modes that don't print results
+// to stdout, like serve, or don't print them at all, like bench
+func rejectOutput(mode string) {
+    if *outputName != "" {
+        log.Fatalf("%s: --output isn't supported\n", mode)
+    }
+}
+
+// createOutput starts writing the results for name
+func createOutput(name string) (*outputFile, error) {
+    dir, base := filepath.Split(name)
+    if dir == "" {
+        dir = "."
+    }
+    tmp, err := createTemp(dir, base)
+    if err != nil {
+        return nil, &fs.PathError{Op: "create", Path: name, Err: errors.Unwrap(err)}
+    }
+    o := &outputFile{name: name, tmp: tmp, buf: bufio.NewWriterSize(tmp, 64<<10)}
+    o.w = o.buf
+    if strings.HasSuffix(name, ".gz") {
+        o.zw = gzip.NewWriter(o.buf)
+        o.w = o.zw
+    }
+
+    // Interrupting the search leaves nothing behind either
+    interrupted := make(chan os.Signal, 1)
+    signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-interrupted
+        tmp.Close()
+        os.Remove(tmp.Name())
+        os.Exit(130)
+    }()
+    return o, nil
+}
+
+// createTemp creates the temporary file for base in dir. Unlike
+// os.CreateTemp it leaves the permissions to the umask, like the shell
+// does for a new file.
+func createTemp(dir, base string) (*os.File, error) {
+    for {
+        name := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", base, rand.Uint32()))
+        tmp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+        if !errors.Is(err, fs.ErrExist) {
+            return tmp, err
+        }
+    }
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+    if o.err != nil {
+        return 0, o.err
+    }
+    n, err := o.w.Write(p)
+    o.err = err
+    return n, err
+}
+
+// commit flushes the results and gives the file its name. If anything
+// failed, the temporary file is removed instead.
+func (o *outputFile) commit() error {
+    err := o.err
+    if o.zw != nil && err == nil {
+        err = o.zw.Close()
+    }
+    if err == nil {
+        err = o.buf.Flush()
+    }
+    if info, statErr := os.Stat(o.name); err == nil && statErr == nil {
+        // The file replaced keeps its permissions
+        err = o.tmp.Chmod(info.Mode().Perm())
+    }
+    if closeErr := o.tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(o.tmp.Name(), o.name)
+    }
+    if err != nil {
+        os.Remove(o.tmp.Name())
+    }
+    return err
+}
+
+// commitOutput commits the --output file of a search that failed with
+// err, if there is a file. It returns err, or else the failed commit.
+func commitOutput(out *outputFile, err error) error {
+    if out == nil {
+        return err
+    }
+    if outErr := out.commit(); outErr != nil {
+        log.Printf("error: %s\n", outErr)
+        if err == nil {
+            err = outErr
+        }
+    }
+    return err
+}
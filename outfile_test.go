@@ -0,0 +1,47 @@
+package main
+
+import (
+    "compress/gzip"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestOutputFile(t *testing.T) {
+    for _, name := range []string{"out.txt", "out.txt.gz"} {
+        dir := t.TempDir()
+        path := filepath.Join(dir, name)
+        out, err := createOutput(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        io.WriteString(out, "a.txt:foo\n")
+        if _, err := os.Stat(path); err == nil {
+            t.Errorf("%s: there before the commit", name)
+        }
+        if err := out.commit(); err != nil {
+            t.Fatal(err)
+        }
+
+        file, err := os.Open(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var r io.Reader = file
+        if filepath.Ext(name) == ".gz" {
+            if r, err = gzip.NewReader(file); err != nil {
+                t.Fatal(err)
+            }
+        }
+        got, err := io.ReadAll(r)
+        file.Close()
+        if err != nil || string(got) != "a.txt:foo\n" {
+            t.Errorf("%s: got %q, %v", name, got, err)
+        }
+        // The temporary file took the name
+        if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+            t.Errorf("%s: got %d files, want 1", name, len(entries))
+        }
+    }
+}
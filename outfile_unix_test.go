@@ -0,0 +1,39 @@
+//go:build unix
+
+package main
+
+import (
+    "io/fs"
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+)
+
+// A new --output file gets the permissions of the umask, a file that is
+// replaced keeps its own
+func TestOutputFileMode(t *testing.T) {
+    defer syscall.Umask(syscall.Umask(0o027))
+    path := filepath.Join(t.TempDir(), "out.txt")
+    for _, want := range []fs.FileMode{0o640, 0o600} {
+        if want == 0o600 {
+            if err := os.Chmod(path, want); err != nil {
+                t.Fatal(err)
+            }
+        }
+        out, err := createOutput(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := out.commit(); err != nil {
+            t.Fatal(err)
+        }
+        info, err := os.Stat(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := info.Mode().Perm(); got != want {
+            t.Errorf("got mode %o, want %o", got, want)
+        }
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// The exit status of a search with errors, like in grep
+const exitTrouble = 2
+
+// The exit status of a search cut short by --max-bytes-scanned
+const exitTruncated = 3
+
+// The exit status of a search that broke the --fail-on-match or
+// --fail-if-missing policy
+const exitPolicy = 1
+
+// keepSummary passes the results on to sink, and returns the summary
+// of the search once sink got it, nil before
+func keepSummary(sink grep.Sink) (grep.Sink, func() *grep.Summary) {
+    var searched *grep.Summary
+    return func(result grep.Result) error {
+        if result.Summary != nil {
+            searched = result.Summary
+        }
+        return sink(result)
+    }, func() *grep.Summary { return searched }
+}
+
+// exitStatus logs how a search that failed with err, or was summed up
+// by searched, went wrong, and returns its exit status: 1 for a broken
+// policy, 3 for a search cut short by --max-bytes-scanned, 2 for errors
+// and a timed out search and 0 otherwise. A forbidden match is certain,
+// even if the search wasn't complete, a missing one only if it was.
+func exitStatus(ctx context.Context, err error, searched *grep.Summary) int {
+    if ctx.Err() != nil {
+        log.Printf("error: search timed out after %s\n", *timeout)
+        return exitTrouble
+    }
+    violation := policyViolation(searched)
+    switch {
+    case violation != "" && *failOnMatch:
+    case errors.Is(err, grep.ErrScanLimit):
+        return exitTruncated
+    case err != nil || searched != nil && searched.Failures() > 0:
+        return exitTrouble
+    case violation == "":
+        return 0
+    }
+    log.Printf("error: %s\n", violation)
+    return exitPolicy
+}
+
+// policyViolation returns why the search broke the exit policy for CI
+// checks, or "" if it didn't: --fail-on-match fails, if the forbidden
+// pattern is found, and --fail-if-missing, if the required one isn't.
+func policyViolation(searched *grep.Summary) string {
+    matches := 0
+    if searched != nil {
+        matches = searched.Matches
+    }
+    switch {
+    case *failOnMatch && matches > 0:
+        return fmt.Sprintf("--fail-on-match: the pattern was found %d times", matches)
+    case *failIfMissing && matches == 0:
+        return "--fail-if-missing: the pattern was not found"
+    }
+    return ""
+}
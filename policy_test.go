@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+func TestExitStatus(t *testing.T) {
+    found := &grep.Summary{Matches: 2}
+    missing := &grep.Summary{}
+    failed := &grep.Summary{Matches: 2, Errors: map[string]int{"permission denied": 1}}
+    tests := []struct {
+        args     []string
+        err      error
+        searched *grep.Summary
+        want     int
+    }{
+        {nil, nil, found, 0},
+        {nil, nil, missing, 0},
+        {nil, nil, failed, exitTrouble},
+        {nil, errors.New("no such file"), nil, exitTrouble},
+        {nil, grep.ErrScanLimit, found, exitTruncated},
+        {[]string{"--fail-on-match"}, nil, found, exitPolicy},
+        {[]string{"--fail-on-match"}, nil, missing, 0},
+        {[]string{"--fail-on-match"}, nil, failed, exitPolicy},
+        {[]string{"--fail-on-match"}, grep.ErrScanLimit, found, exitPolicy},
+        {[]string{"--fail-if-missing"}, nil, found, 0},
+        {[]string{"--fail-if-missing"}, nil, missing, exitPolicy},
+        {[]string{"--fail-if-missing"}, nil, nil, exitPolicy},
+        {[]string{"--fail-if-missing"}, grep.ErrScanLimit, missing, exitTruncated},
+        {[]string{"--fail-if-missing"}, errors.New("no such file"), nil, exitTrouble},
+    }
+    for _, test := range tests {
+        setOptions(t, append(test.args, "foo")...)
+        if got := exitStatus(context.Background(), test.err, test.searched); got != test.want {
+            t.Errorf("%q, %v, %+v: got %d, want %d", test.args, test.err, test.searched, got, test.want)
+        }
+    }
+}
+
+// A timed out search is a failure, whatever it found
+func TestExitStatusTimeout(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    for _, args := range [][]string{nil, {"--fail-on-match"}, {"--fail-if-missing"}} {
+        setOptions(t, append(args, "foo")...)
+        for _, searched := range []*grep.Summary{{Matches: 2}, {}} {
+            if got := exitStatus(ctx, nil, searched); got != exitTrouble {
+                t.Errorf("%q, %+v: got %d, want %d", args, searched, got, exitTrouble)
+            }
+        }
+    }
+}
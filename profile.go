@@ -0,0 +1,100 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    _ "net/http/pprof" // the handlers of --pprof
+    "os"
+    "runtime"
+    "runtime/pprof"
+    "strings"
+)
+
+// The profiles of --profile
+var profileKinds = map[string]bool{"cpu": true, "mem": true, "block": true, "mutex": true}
+
+// parseProfiles parses a --profile spec like cpu=prof.out,mem=mem.out
+// into the files by kind of profile
+func parseProfiles(spec string) (map[string]string, error) {
+    files := make(map[string]string)
+    if spec == "" {
+        return files, nil
+    }
+    for _, item := range strings.Split(spec, ",") {
+        kind, file, ok := strings.Cut(item, "=")
+        if !ok || file == "" {
+            return nil, fmt.Errorf("invalid profile %q, want kind=file", item)
+        }
+        if !profileKinds[kind] {
+            return nil, fmt.Errorf("invalid profile kind %q, want cpu, mem, block or mutex", kind)
+        }
+        files[kind] = file
+    }
+    return files, nil
+}
+
+// mustProfile starts the profiles of --profile and the --pprof listener.
+// The returned function writes the profiles, it has to be called before
+// the program ends. The samples of the workers are labeled with their
+// number. It exits on errors.
+func mustProfile() func() {
+    if *pprofAddr != "" {
+        go func() {
+            if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+                log.Printf("error: pprof: %s\n", err)
+            }
+        }()
+    }
+
+    files, err := parseProfiles(*profileSpec)
+    if err != nil {
+        log.Fatalf("%s\n", err)
+    }
+    if files["block"] != "" {
+        runtime.SetBlockProfileRate(1)
+    }
+    if files["mutex"] != "" {
+        runtime.SetMutexProfileFraction(1)
+    }
+    var cpu *os.File
+    if name := files["cpu"]; name != "" {
+        if cpu, err = os.Create(name); err != nil {
+            log.Fatalf("%s\n", err)
+        }
+        if err := pprof.StartCPUProfile(cpu); err != nil {
+            log.Fatalf("cpu profile: %s\n", err)
+        }
+    }
+
+    return func() {
+        if cpu != nil {
+            pprof.StopCPUProfile()
+            if err := cpu.Close(); err != nil {
+                log.Printf("error: %s\n", err)
+            }
+        }
+        for kind, profile := range map[string]string{"mem": "allocs", "block": "block", "mutex": "mutex"} {
+            if name := files[kind]; name != "" {
+                if err := writeProfile(profile, name); err != nil {
+                    log.Printf("error: %s profile: %s\n", kind, err)
+                }
+            }
+        }
+    }
+}
+
+// writeProfile writes the named runtime profile to the file name
+func writeProfile(profile, name string) error {
+    if profile == "allocs" {
+        // Up to date statistics
+        runtime.GC()
+    }
+    file, err := os.Create(name)
+    if err != nil {
+        return err
+    }
+    err = pprof.Lookup(profile).WriteTo(file, 0)
+    return errors.Join(err, file.Close())
+}
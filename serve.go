@@ -0,0 +1,498 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "io"
+    "log"
+    "os"
+    "sync"
+
+    "github.com/miromotl/concurrent-grep/grep"
+)
+
+// The JSON-RPC error codes of serve mode, the last one is taken from LSP
+const (
+    rpcParseError     = -32700
+    rpcInvalidRequest = -32600
+    rpcNoMethod       = -32601
+    rpcInvalidParams  = -32602
+    rpcInternalError  = -32603
+    rpcCancelled      = -32800
+    rpcNotCached      = -32001 // cgrep daemon doesn't have the files of the search
+)
+
+// The searches waiting for their turn in serve mode
+const maxQueuedSearches = 64
+
+// The compiled patterns kept for the next searches
+const maxCachedPatterns = 64
+
+// The messages of serve mode. Requests and responses are JSON-RPC 2.0,
+// one message per line.
+type (
+    rpcRequest struct {
+        Version string          `json:"jsonrpc"`
+        ID      json.RawMessage `json:"id,omitempty"`
+        Method  string          `json:"method"`
+        Params  json.RawMessage `json:"params,omitempty"`
+    }
+    rpcResponse struct {
+        Version string          `json:"jsonrpc"`
+        ID      json.RawMessage `json:"id"`
+        Result  any             `json:"result"`
+    }
+    rpcFailure struct {
+        Version string          `json:"jsonrpc"`
+        ID      json.RawMessage `json:"id"`
+        Error   rpcError        `json:"error"`
+    }
+    rpcError struct {
+        Code    int    `json:"code"`
+        Message string `json:"message"`
+    }
+    rpcNotification struct {
+        Version string `json:"jsonrpc"`
+        Method  string `json:"method"`
+        Params  any    `json:"params"`
+    }
+    // A record of the --json stream of a search
+    resultParams struct {
+        ID     json.RawMessage `json:"id"`
+        Record json.RawMessage `json:"record"`
+    }
+    cancelParams struct {
+        ID json.RawMessage `json:"id"`
+    }
+    // The options of a search, those left out are taken from the
+    // command line of serve
+    searchParams struct {
+        Pattern          string   `json:"pattern"`
+        Paths            []string `json:"paths"`
+        Cwd              string   `json:"cwd"` // for the relative paths, only with cgrep daemon
+        IgnoreCase       *bool    `json:"ignoreCase"`
+        FixedStrings     *bool    `json:"fixedStrings"`
+        Context          *int     `json:"context"`
+        Before           *int     `json:"before"`
+        After            *int     `json:"after"`
+        Count            *bool    `json:"count"`
+        FilesWithMatches *bool    `json:"filesWithMatches"`
+        // The walk the client would do, only with cgrep daemon
+        Walk *walkParams `json:"walk"`
+    }
+    // The options that decide which files a walk finds
+    walkParams struct {
+        NoIgnore bool   `json:"noIgnore"`
+        MaxDepth int    `json:"maxDepth"`
+        Follow   bool   `json:"follow"`
+        Devices  string `json:"devices"`
+    }
+)
+
+// serveMain runs "cgrep serve [options]": editors keep it running as a
+// child process, and send their searches as JSON-RPC requests to its
+// standard input, instead of starting cgrep for each of them.
+//
+// A "search" request names the pattern, and optionally the paths, which
+// default to the current directory, and -i, -F, -A, -B, -C, -c and -l.
+// The records of the --json stream are sent as "result" notifications
+// with the id of the search, the response holds the summary. The ids of
+// the searches in flight must differ. Searches run one after the other,
+// "$/cancelRequest" cancels a running or waiting one. "shutdown" waits
+// for the searches, and ends the server, like the end of the input.
+func serveMain(args []string) {
+    flag.Usage = usage
+    flag.CommandLine.Parse(args)
+    if flag.NArg() > 0 {
+        log.Fatalf("serve: unexpected arguments, the patterns come with the requests\n")
+    }
+    checkOptions()
+    rejectOutput("serve")
+    stopProfiles := mustProfile()
+    defer stopProfiles()
+    setupServer()
+
+    srv := newServer(nil)
+    srv.serve(os.Stdin, os.Stdout)
+    srv.close()
+}
+
+// setupServer sets the options, that the searches of serve and daemon
+// mode have in common
+func setupServer() {
+    // The records go to the editor, which wants them all and in order
+    opts.JSON = true
+    if !opts.Follow {
+        opts.Recursive = true
+    }
+    opts.Filenames = true
+    opts.LineNumbers = !*noLineNumber
+}
+
+// A server runs the searches of serve and daemon mode, one at a time.
+// The compiled patterns are kept between the searches.
+type server struct {
+    searches chan serverSearch
+    done     chan struct{}
+    patterns map[patternKey]*grep.Pattern // only used by the searching goroutine
+    opts     grep.Options                 // the options of the command line
+    base     searchOptions
+    files    *fileCache // the files of cgrep daemon, nil for serve
+}
+
+// A session answers the requests of a client, on stdin and stdout
+// for serve, on a connection for daemon
+type session struct {
+    srv     *server
+    conn    *rpcConn
+    mu      sync.Mutex
+    cancels map[string]context.CancelFunc // the searches by id
+    pending sync.WaitGroup
+    // The id of "shutdown", answered at the end
+    shutdown json.RawMessage
+}
+
+// A search waiting for its turn
+type serverSearch struct {
+    ctx     context.Context
+    session *session
+    id      json.RawMessage
+    params  searchParams
+}
+
+// The options a search may change
+type searchOptions struct {
+    ignoreCase, fixedStrings bool
+    before, after            int
+    count, filesOnly         bool
+}
+
+// The patterns keep the options they were compiled with
+type patternKey struct {
+    expr string
+    opts searchOptions
+}
+
+// newServer returns a server of the searches, which searches the cached
+// files, if there are any
+func newServer(files *fileCache) *server {
+    srv := &server{
+        searches: make(chan serverSearch, maxQueuedSearches),
+        done:     make(chan struct{}),
+        patterns: make(map[patternKey]*grep.Pattern),
+        opts:     opts,
+        base: searchOptions{opts.IgnoreCase, opts.FixedStrings, contextLines(opts.Before, opts.Context),
+            contextLines(opts.After, opts.Context), opts.CountOnly || opts.CountMatches, opts.FilesOnly},
+        files: files,
+    }
+    go func() {
+        defer close(srv.done)
+        for search := range srv.searches {
+            search.session.search(search)
+        }
+    }()
+    return srv
+}
+
+// close waits for the searches left, no more sessions may begin
+func (srv *server) close() {
+    close(srv.searches)
+    <-srv.done
+}
+
+// serve reads the requests of a session from in, until it ends or
+// "shutdown", and waits for its searches. At the end of in, the searches
+// are cancelled, as nobody reads their results any more.
+func (srv *server) serve(in io.Reader, out io.Writer) {
+    s := &session{srv: srv, conn: &rpcConn{enc: json.NewEncoder(out)},
+        cancels: make(map[string]context.CancelFunc)}
+    reader := bufio.NewReader(in)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if len(bytes.TrimSpace(line)) > 0 && !s.handle(line) {
+            break
+        }
+        if err != nil {
+            if err != io.EOF {
+                log.Printf("error: serve: %s\n", err)
+            }
+            s.cancelAll()
+            break
+        }
+    }
+    s.pending.Wait()
+    if s.shutdown != nil {
+        s.conn.reply(s.shutdown, nil)
+    }
+}
+
+// handle answers a single request. It returns false after "shutdown".
+func (s *session) handle(line []byte) bool {
+    var req rpcRequest
+    if err := json.Unmarshal(line, &req); err != nil {
+        s.conn.fail(nil, rpcParseError, err.Error())
+        return true
+    }
+    if req.Version != "2.0" || req.Method == "" {
+        s.conn.fail(req.ID, rpcInvalidRequest, "not a JSON-RPC 2.0 request")
+        return true
+    }
+
+    switch req.Method {
+    case "search":
+        var params searchParams
+        if err := json.Unmarshal(req.Params, &params); err != nil || params.Pattern == "" {
+            s.conn.fail(req.ID, rpcInvalidParams, "search needs a pattern")
+            return true
+        }
+        if req.ID == nil {
+            s.conn.fail(nil, rpcInvalidRequest, "search needs an id")
+            return true
+        }
+        ctx, cancel := context.WithCancel(context.Background())
+        s.mu.Lock()
+        if _, running := s.cancels[string(req.ID)]; running {
+            // The id couldn't tell the answers, nor the searches to cancel
+            s.mu.Unlock()
+            cancel()
+            s.conn.fail(req.ID, rpcInvalidRequest, "duplicate id "+string(req.ID))
+            return true
+        }
+        s.cancels[string(req.ID)] = cancel
+        s.mu.Unlock()
+        s.pending.Add(1)
+        select {
+        case s.srv.searches <- serverSearch{ctx, s, req.ID, params}:
+        default:
+            s.finish(req.ID)
+            s.conn.fail(req.ID, rpcInternalError, "too many searches waiting")
+        }
+    case "$/cancelRequest":
+        var params cancelParams
+        if err := json.Unmarshal(req.Params, &params); err == nil {
+            s.mu.Lock()
+            if cancel, ok := s.cancels[string(params.ID)]; ok {
+                cancel()
+            }
+            s.mu.Unlock()
+        }
+    case "shutdown":
+        s.shutdown = req.ID
+        return false
+    default:
+        if req.ID != nil {
+            s.conn.fail(req.ID, rpcNoMethod, "unknown method "+req.Method)
+        }
+    }
+    return true
+}
+
+// search runs a search with options of its own, those of the command
+// line changed by the request, and answers its request
+func (s *session) search(search serverSearch) {
+    defer s.finish(search.id)
+    if search.ctx.Err() != nil {
+        s.conn.fail(search.id, rpcCancelled, "search cancelled")
+        return
+    }
+
+    searchOpts, err := s.srv.options(search.params)
+    if err != nil {
+        s.conn.fail(search.id, rpcInvalidParams, err.Error())
+        return
+    }
+    pat, err := s.srv.compile(search.params.Pattern, searchOpts)
+    if err != nil {
+        s.conn.fail(search.id, rpcInvalidParams, err.Error())
+        return
+    }
+    paths, names, code, err := s.srv.paths(search.params)
+    if err != nil {
+        s.conn.fail(search.id, code, err.Error())
+        return
+    }
+
+    ctx := search.ctx
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
+    }
+    var summary *grep.Summary
+    sink := grep.WriterSink(&notifyWriter{s.conn, search.id}, pat)
+    err = grep.Search(ctx, pat, paths, func(result grep.Result) error {
+        if result.Summary != nil {
+            summary = result.Summary
+        }
+        if names != nil {
+            result = rename(result, names)
+        }
+        return sink(result)
+    })
+    switch {
+    case search.ctx.Err() != nil:
+        s.conn.fail(search.id, rpcCancelled, "search cancelled")
+    case err != nil && !errors.Is(err, grep.ErrScanLimit):
+        s.conn.fail(search.id, rpcInternalError, err.Error())
+    default:
+        s.conn.reply(search.id, summary)
+    }
+}
+
+// contextLines returns the lines of context before or after a match of
+// the command line, n for -A or -B, which win over -C
+func contextLines(n, context int) int {
+    if n == 0 {
+        return context
+    }
+    return n
+}
+
+// options returns the options of a search, those left out are the ones
+// of the command line
+func (srv *server) options(params searchParams) (searchOptions, error) {
+    opts := srv.base
+    if params.IgnoreCase != nil {
+        opts.ignoreCase = *params.IgnoreCase
+    }
+    if params.FixedStrings != nil {
+        opts.fixedStrings = *params.FixedStrings
+    }
+    if params.Context != nil {
+        opts.before, opts.after = *params.Context, *params.Context
+    }
+    if params.Before != nil {
+        opts.before = *params.Before
+    }
+    if params.After != nil {
+        opts.after = *params.After
+    }
+    if opts.before < 0 || opts.after < 0 {
+        return opts, errors.New("invalid number of context lines")
+    }
+    if params.Count != nil {
+        opts.count = *params.Count
+    }
+    if params.FilesWithMatches != nil {
+        opts.filesOnly = *params.FilesWithMatches
+    }
+    return opts, nil
+}
+
+// paths returns the files to search for params, with the JSON-RPC error
+// code of a failure. The daemon searches its cached files instead of
+// walking the directories, the names of the files for the client come
+// along.
+func (srv *server) paths(params searchParams) ([]string, map[string]string, int, error) {
+    paths := params.Paths
+    if len(paths) == 0 {
+        paths = []string{"."}
+    }
+    for _, path := range paths {
+        if grep.IsStdin(path) {
+            return nil, nil, rpcInvalidParams, errors.New("the standard input can't be searched")
+        }
+    }
+    if srv.files == nil {
+        return commandLineFiles(paths), nil, 0, nil
+    }
+    if params.Walk != nil && *params.Walk != srv.files.walk {
+        return nil, nil, rpcNotCached, errors.New("the daemon walked its roots with other options")
+    }
+    files, names, ok := srv.files.lookup(params.Cwd, paths)
+    if !ok {
+        return nil, nil, rpcNotCached, errors.New("the paths aren't below the roots of the daemon")
+    }
+    return files, names, 0, nil
+}
+
+// compile returns the pattern of expr with the options of the search,
+// from the cache if it was compiled before. The options are a copy of
+// those of the command line, so nothing is left over from the searches
+// before.
+func (srv *server) compile(expr string, searchOpts searchOptions) (*grep.Pattern, error) {
+    key := patternKey{expr, searchOpts}
+    if pat, ok := srv.patterns[key]; ok {
+        return pat, nil
+    }
+    opts := srv.opts
+    opts.IgnoreCase, opts.FixedStrings = searchOpts.ignoreCase, searchOpts.fixedStrings
+    // The context of the search is complete, -C doesn't add to it
+    opts.Before, opts.After, opts.Context = searchOpts.before, searchOpts.after, 0
+    opts.CountOnly, opts.FilesOnly = searchOpts.count, searchOpts.filesOnly
+    if !searchOpts.count {
+        opts.CountMatches = false
+    }
+    pat, err := grep.Compile(opts, expr)
+    if err != nil {
+        return nil, err
+    }
+    if len(srv.patterns) >= maxCachedPatterns {
+        clear(srv.patterns)
+    }
+    srv.patterns[key] = pat
+    return pat, nil
+}
+
+// finish forgets a search, which can't be cancelled any more
+func (s *session) finish(id json.RawMessage) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if cancel, ok := s.cancels[string(id)]; ok {
+        cancel()
+        delete(s.cancels, string(id))
+    }
+    s.pending.Done()
+}
+
+// cancelAll cancels the running and the waiting searches
+func (s *session) cancelAll() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, cancel := range s.cancels {
+        cancel()
+    }
+}
+
+// An rpcConn writes the messages of serve mode, one at a time
+type rpcConn struct {
+    mu  sync.Mutex
+    enc *json.Encoder
+}
+
+func (c *rpcConn) send(msg any) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.enc.Encode(msg)
+}
+
+func (c *rpcConn) reply(id json.RawMessage, result any) {
+    c.send(rpcResponse{"2.0", id, result})
+}
+
+func (c *rpcConn) fail(id json.RawMessage, code int, message string) {
+    if id == nil {
+        id = json.RawMessage("null")
+    }
+    c.send(rpcFailure{"2.0", id, rpcError{code, message}})
+}
+
+// notifyWriter sends each record of the --json stream, which the printer
+// writes at once, as a "result" notification of the search id
+type notifyWriter struct {
+    conn *rpcConn
+    id   json.RawMessage
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+    record := json.RawMessage(bytes.TrimSpace(b))
+    err := w.conn.send(rpcNotification{"2.0", "result", resultParams{w.id, record}})
+    if err != nil {
+        return 0, err
+    }
+    return len(b), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "testing"
+)
+
+// A second search with the id of one in flight is refused, and the
+// first one can still be cancelled
+func TestServeDuplicateID(t *testing.T) {
+    var out bytes.Buffer
+    srv := &server{searches: make(chan serverSearch, maxQueuedSearches)}
+    s := &session{srv: srv, conn: &rpcConn{enc: json.NewEncoder(&out)},
+        cancels: make(map[string]context.CancelFunc)}
+    search := `{"jsonrpc":"2.0","id":1,"method":"search","params":{"pattern":"foo"}}`
+    s.handle([]byte(search))
+    s.handle([]byte(search))
+
+    var failure rpcFailure
+    if err := json.Unmarshal(out.Bytes(), &failure); err != nil {
+        t.Fatalf("%s: %s", out.Bytes(), err)
+    }
+    if failure.Error.Code != rpcInvalidRequest || string(failure.ID) != "1" {
+        t.Errorf("got %s, want an invalid request of id 1", out.Bytes())
+    }
+    if len(srv.searches) != 1 {
+        t.Fatalf("got %d searches waiting, want 1", len(srv.searches))
+    }
+
+    s.handle([]byte(`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`))
+    if first := <-srv.searches; first.ctx.Err() == nil {
+        t.Error("the first search wasn't cancelled")
+    }
+}
+
+// A search gets the options of the command line changed by its request
+// only, none derived from them or left over from the searches before
+func TestServeFreshOptions(t *testing.T) {
+    fname := filepath.Join(t.TempDir(), "a.txt")
+    if err := os.WriteFile(fname, []byte("one\nFoo\ntwo\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    setOptions(t, "--count-matches", "unused")
+    setupServer()
+    srv := newServer(nil)
+    defer srv.close()
+
+    paths, _ := json.Marshal([]string{fname})
+    requests := []string{
+        `{"jsonrpc":"2.0","id":1,"method":"search","params":{"pattern":"foo","paths":` + string(paths) +
+            `,"ignoreCase":true,"context":1,"count":true}}`,
+        `{"jsonrpc":"2.0","id":2,"method":"search","params":{"pattern":"Foo","paths":` + string(paths) +
+            `,"count":false}}`,
+        `{"jsonrpc":"2.0","id":3,"method":"shutdown"}`,
+    }
+    var out bytes.Buffer
+    srv.serve(strings.NewReader(strings.Join(requests, "\n")+"\n"), &out)
+
+    var types []string
+    for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+        var msg struct {
+            Params resultParams `json:"params"`
+        }
+        if err := json.Unmarshal([]byte(line), &msg); err != nil {
+            t.Fatalf("%s: %s", line, err)
+        }
+        if string(msg.Params.ID) != "2" {
+            continue
+        }
+        var record struct {
+            Type string `json:"type"`
+        }
+        json.Unmarshal(msg.Params.Record, &record)
+        types = append(types, record.Type)
+    }
+    if want := []string{"begin", "match", "end", "summary"}; !slices.Equal(types, want) {
+        t.Errorf("got records %q of the second search, want %q", types, want)
+    }
+}
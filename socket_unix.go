@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "syscall"
+)
+
+// listenPrivate listens on the unix socket path, which only the user
+// may connect to from the start: it is created under a umask that
+// leaves out the others
+func listenPrivate(path string) (net.Listener, error) {
+    defer syscall.Umask(syscall.Umask(0o077))
+    return net.Listen("unix", path)
+}
+
+// checkPrivate returns an error, unless path belongs to the user and
+// nobody else may read or write it. A socket of somebody else could
+// answer the searches with anything, and learn what they look for.
+func checkPrivate(path string) error {
+    info, err := os.Lstat(path)
+    if err != nil {
+        return err
+    }
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok || int(st.Uid) != os.Getuid() {
+        return fmt.Errorf("%s belongs to another user", path)
+    }
+    if info.Mode().Perm()&0o077 != 0 {
+        return fmt.Errorf("%s may be used by other users, its mode is %s", path, info.Mode().Perm())
+    }
+    return nil
+}